@@ -0,0 +1,19 @@
+package xtest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"test/go_rules/xtest"
+)
+
+func TestGetAnswer(t *testing.T) {
+	if answer := xtest.GetAnswer(); answer != 42 {
+		t.Errorf("Unexpected answer: %d", answer)
+	}
+}
+
+func ExampleGetAnswer() {
+	fmt.Println(xtest.GetAnswer())
+	// Output: 42
+}
@@ -0,0 +1,9 @@
+package xtest
+
+import "testing"
+
+func TestHalf(t *testing.T) {
+	if half != 21 {
+		t.Errorf("Unexpected half: %d", half)
+	}
+}
@@ -0,0 +1,9 @@
+// Package xtest is used for testing go_test with external test packages.
+package xtest
+
+// GetAnswer returns the answer.
+func GetAnswer() int {
+	return 2 * half
+}
+
+const half = 21
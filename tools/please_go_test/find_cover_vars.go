@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/op/go-logging.v1"
@@ -21,6 +22,7 @@ type CoverVar struct {
 }
 
 // FindCoverVars searches the given directory recursively to find all Go files with coverage variables.
+// Exclusions can be either exact paths or glob patterns as understood by filepath.Match.
 func FindCoverVars(dir string, exclude, srcs []string) ([]CoverVar, error) {
 	if dir == "" {
 		return nil, nil
@@ -31,11 +33,14 @@ func FindCoverVars(dir string, exclude, srcs []string) ([]CoverVar, error) {
 	}
 	ret := []CoverVar{}
 
-	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+	err := walk(dir, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if _, present := excludeMap[name]; present {
-			return filepath.SkipDir
+		} else if isExcluded(name, excludeMap) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		} else if strings.HasSuffix(name, ".a") && !strings.ContainsRune(path.Base(name), '#') {
 			vars, err := findCoverVars(name, srcs)
 			if err != nil {
@@ -50,22 +55,131 @@ func FindCoverVars(dir string, exclude, srcs []string) ([]CoverVar, error) {
 	return ret, err
 }
 
+// FilterCoverVars returns only the cover vars whose files are in the given set of sources.
+// This allows instrumenting one set of sources independently of the tests being run.
+func FilterCoverVars(vars []CoverVar, srcs []string) []CoverVar {
+	ret := make([]CoverVar, 0, len(vars))
+	for _, v := range vars {
+		for _, src := range srcs {
+			if path.Clean(src) == v.File {
+				ret = append(ret, v)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// walk is like filepath.Walk but follows symlinks to directories.
+// Any directory that has already been visited (for example via a symlink cycle) is skipped.
+func walk(root string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	err = walkDir(root, info, map[string]struct{}{}, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDir(name string, info os.FileInfo, visited map[string]struct{}, fn filepath.WalkFunc) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(name)
+		if err != nil {
+			return fn(name, info, err)
+		}
+		info = target
+	}
+	if info.IsDir() {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return fn(name, info, err)
+		} else if _, present := visited[resolved]; present {
+			log.Warning("Not descending into %s; %s has already been visited", name, resolved)
+			return nil
+		}
+		visited[resolved] = struct{}{}
+	}
+	if err := fn(name, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+	names, err := readDirNames(name)
+	if err != nil {
+		return fn(name, info, err)
+	}
+	for _, n := range names {
+		filename := filepath.Join(name, n)
+		fileInfo, err := os.Lstat(filename)
+		if err != nil {
+			if err := fn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else if err := walkDir(filename, fileInfo, visited, fn); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the entries in a directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	sort.Strings(names)
+	return names, err
+}
+
+// isExcluded returns true if the given path matches any of the exclusions.
+func isExcluded(name string, exclude map[string]struct{}) bool {
+	if _, present := exclude[name]; present {
+		return true
+	}
+	for e := range exclude {
+		if matched, _ := filepath.Match(e, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadExcludes reads a set of exclusions from the given file, one per line.
+// Blank lines and lines beginning with a # are ignored.
+func ReadExcludes(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			ret = append(ret, strings.TrimSuffix(line, "/"))
+		}
+	}
+	return ret, nil
+}
+
 // findCoverVars scans a directory containing a .a file for any go files.
-func findCoverVars(filepath string, srcs []string) ([]CoverVar, error) {
-	dir, file := path.Split(filepath)
-	dir = strings.TrimRight(dir, "/")
+func findCoverVars(filename string, srcs []string) ([]CoverVar, error) {
+	dir, file := filepath.Split(filename)
+	dir = strings.TrimRight(dir, string(filepath.Separator))
 	fi, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	importPath := collapseFinalDir(strings.TrimPrefix(strings.TrimSuffix(filepath, ".a"), "src/"))
+	importPath := collapseFinalDir(strings.TrimPrefix(strings.TrimSuffix(toSlash(filename), ".a"), "src/"))
 	ret := make([]CoverVar, 0, len(fi))
 	for _, info := range fi {
 		if info.Name() != file && strings.HasSuffix(info.Name(), ".a") {
 			log.Warning("multiple .a files in %s, can't determine coverage variables accurately", dir)
 			return nil, nil
 		}
-		if strings.HasSuffix(info.Name(), ".go") && !info.IsDir() && !contains(path.Join(dir, info.Name()), srcs) {
+		if strings.HasSuffix(info.Name(), ".go") && !info.IsDir() && !contains(filepath.Join(dir, info.Name()), srcs) {
 			// N.B. The scheme here must match what we do in go_rules.build_defs
 			v := "GoCover_" + strings.Replace(info.Name(), ".", "_", -1)
 			ret = append(ret, coverVar(dir, importPath, v))
@@ -85,7 +199,7 @@ func contains(needle string, haystack []string) bool {
 
 func coverVar(dir, importPath, v string) CoverVar {
 	log.Info("Found cover variable: %s %s %s", dir, importPath, v)
-	f := path.Join(dir, strings.TrimPrefix(v, "GoCover_"))
+	f := path.Join(toSlash(dir), strings.TrimPrefix(v, "GoCover_"))
 	if strings.HasSuffix(f, "_go") {
 		f = f[:len(f)-3] + ".go"
 	}
@@ -100,8 +214,16 @@ func coverVar(dir, importPath, v string) CoverVar {
 // collapseFinalDir mimics what go does with import paths; if the final two components of
 // the given path are the same (eg. "src/core/core") it collapses them into one ("src/core")
 func collapseFinalDir(s string) string {
+	s = toSlash(s)
 	if path.Base(path.Dir(s)) == path.Base(s) {
 		return path.Dir(s)
 	}
 	return s
 }
+
+// toSlash converts any backslashes in the given path to forward slashes.
+// Unlike filepath.ToSlash it does this on every OS; paths from Windows tools can turn up anywhere
+// and neither import paths nor the file names we record for coverage should contain backslashes.
+func toSlash(p string) string {
+	return strings.Replace(p, `\`, "/", -1)
+}
@@ -1,6 +1,9 @@
 package buildgo
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,7 +18,7 @@ var coverageVars = []CoverVar{{
 }}
 
 func TestFindCoverVars(t *testing.T) {
-	vars, err := FindCoverVars("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/x", "tools/please_go_test/test_data/binary"}, nil)
+	vars, err := FindCoverVars("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/x", "tools/please_go_test/test_data/binary", "tools/please_go_test/test_data/helpers"}, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, coverageVars, vars)
 }
@@ -31,6 +34,23 @@ func TestFindCoverVarsReturnsNothingForEmptyPath(t *testing.T) {
 	assert.Equal(t, 0, len(vars))
 }
 
+func TestFindCoverVarsFollowsSymlinks(t *testing.T) {
+	target, err := filepath.Abs("tools/please_go_test/test_data/binary")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll("symlink_test", 0755))
+	assert.NoError(t, os.Symlink(target, "symlink_test/core"))
+	assert.NoError(t, os.Symlink(".", "symlink_test/loop")) // Points back to itself.
+	expected := []CoverVar{{
+		Dir:        "symlink_test/core",
+		ImportPath: "symlink_test/core",
+		Var:        "GoCover_lock_go",
+		File:       "symlink_test/core/lock.go",
+	}}
+	vars, err := FindCoverVars("symlink_test", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vars)
+}
+
 func TestFindBinaryCoverVars(t *testing.T) {
 	// Test for Go 1.7 binary format.
 	expected := []CoverVar{{
@@ -49,3 +69,69 @@ func TestFindCoverVarsExcludesSrcs(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []CoverVar{}, vars)
 }
+
+func TestFindCoverVarsGlobExclusions(t *testing.T) {
+	vars, err := FindCoverVars("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/[bhx]*"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, coverageVars, vars)
+}
+
+func TestFindCoverVarsExcludesTestHelpers(t *testing.T) {
+	vars, err := FindCoverVars("tools/please_go_test/test_data/helpers", nil, []string{"tools/please_go_test/test_data/helpers/helpers_test.go"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(vars))
+	assert.Equal(t, "GoCover_helpers_go", vars[0].Var)
+}
+
+func TestFindCoverVarsIncludesInstrumentedTestHelpers(t *testing.T) {
+	// This is what happens under --cover_tests; the test sources are no longer excluded.
+	vars, err := FindCoverVars("tools/please_go_test/test_data/helpers", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []CoverVar{
+		{
+			Dir:        "tools/please_go_test/test_data/helpers",
+			ImportPath: "tools/please_go_test/test_data/helpers",
+			Var:        "GoCover_helpers_go",
+			File:       "tools/please_go_test/test_data/helpers/helpers.go",
+		},
+		{
+			Dir:        "tools/please_go_test/test_data/helpers",
+			ImportPath: "tools/please_go_test/test_data/helpers",
+			Var:        "GoCover_helpers_test_go",
+			File:       "tools/please_go_test/test_data/helpers/helpers_test.go",
+		},
+	}, vars)
+}
+
+func TestFilterCoverVars(t *testing.T) {
+	// Instrument the binary package but not the other one, independently of any test sources.
+	vars, err := FindCoverVars("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/x", "tools/please_go_test/test_data/helpers"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(vars))
+	vars = FilterCoverVars(vars, []string{"./tools/please_go_test/test_data/binary/lock.go"})
+	assert.Equal(t, []CoverVar{{
+		Dir:        "tools/please_go_test/test_data/binary",
+		ImportPath: "tools/please_go_test/test_data/binary/core",
+		Var:        "GoCover_lock_go",
+		File:       "tools/please_go_test/test_data/binary/lock.go",
+	}}, vars)
+}
+
+func TestReadExcludes(t *testing.T) {
+	err := ioutil.WriteFile("excludes.txt", []byte("# comment\nthird_party/go\n\n  src/*/test_data/  \n"), 0644)
+	assert.NoError(t, err)
+	excludes, err := ReadExcludes("excludes.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"third_party/go", "src/*/test_data"}, excludes)
+}
+
+func TestCoverVarWindowsPaths(t *testing.T) {
+	v := coverVar(`tools\please_go_test\test_data`, "core", "GoCover_lock_go")
+	assert.Equal(t, "tools/please_go_test/test_data/lock.go", v.File)
+}
+
+func TestCollapseFinalDir(t *testing.T) {
+	assert.Equal(t, "src/core", collapseFinalDir("src/core/core"))
+	assert.Equal(t, "src/core", collapseFinalDir(`src\core\core`))
+	assert.Equal(t, "src/core/lock", collapseFinalDir(`src\core\lock`))
+}
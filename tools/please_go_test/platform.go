@@ -0,0 +1,188 @@
+package buildgo
+
+import (
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+)
+
+// A Platform is a GOOS / GOARCH pair to generate a test main for.
+// Either may be empty, in which case constraints on it aren't evaluated.
+type Platform struct {
+	GOOS, GOARCH string
+}
+
+// BuildTags are any extra build tags to consider set when deciding which files are built.
+var BuildTags []string
+
+// DefaultPlatform returns the platform that test sources are evaluated against if none is given explicitly.
+// It comes from the default build context, so honours $GOOS and $GOARCH.
+func DefaultPlatform() Platform {
+	return Platform{GOOS: build.Default.GOOS, GOARCH: build.Default.GOARCH}
+}
+
+// ParsePlatform parses a platform in the form os/arch, e.g. linux/amd64.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || !knownOS[parts[0]] || !knownArch[parts[1]] {
+		return Platform{}, fmt.Errorf("Invalid platform %s, should be in the form os/arch (e.g. linux/amd64)", s)
+	}
+	return Platform{GOOS: parts[0], GOARCH: parts[1]}, nil
+}
+
+// String returns the platform in the form used for file suffixes, e.g. linux_amd64.
+func (p Platform) String() string {
+	return p.GOOS + "_" + p.GOARCH
+}
+
+// tags returns the build tags that are known to be set or unset for this platform when building with
+// the toolchain described by opts. Like go/build, any tag that isn't in here is unset, apart from
+// operating systems and architectures when the platform doesn't specify one.
+func (p Platform) tags(opts TestMainOptions) map[string]bool {
+	tags := p.platformTags()
+	tags["ignore"] = false
+	tags["cgo"] = CgoEnabled
+	tinygo := opts.Target == "tinygo"
+	tags["tinygo"] = tinygo
+	tags["gc"] = !tinygo
+	tags["gccgo"] = false
+	for _, tag := range releaseTags(opts.GoVersion) {
+		tags[tag] = true
+	}
+	for _, tag := range BuildTags {
+		tags[tag] = true
+	}
+	return tags
+}
+
+// platformTags returns the operating system and architecture tags that are set or unset for this platform.
+func (p Platform) platformTags() map[string]bool {
+	tags := map[string]bool{}
+	if p.GOOS != "" {
+		for os := range knownOS {
+			tags[os] = os == p.GOOS
+		}
+		tags["unix"] = unixOS[p.GOOS]
+		// These imply other operating systems, which Go treats as matching too.
+		switch p.GOOS {
+		case "android":
+			tags["linux"] = true
+		case "illumos":
+			tags["solaris"] = true
+		case "ios":
+			tags["darwin"] = true
+		}
+	}
+	if p.GOARCH != "" {
+		for arch := range knownArch {
+			tags[arch] = arch == p.GOARCH
+		}
+	}
+	return tags
+}
+
+// releaseTags returns the go1.x tags that are set for the given version of Go.
+// If the version isn't known they're taken from the Go this tool was built with instead.
+func releaseTags(version GoVersion) []string {
+	if version == (GoVersion{}) {
+		return build.Default.ReleaseTags
+	}
+	latest := version.Minor
+	if version == develVersion || version.Major > 1 {
+		// Newer than any release we know about, which is at least the one we were built with.
+		latest = len(build.Default.ReleaseTags)
+	}
+	tags := make([]string, latest)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("go1.%d", i+1)
+	}
+	return tags
+}
+
+// matchesFileName returns true if the given filename doesn't have a _GOOS or _GOARCH suffix
+// that excludes it from this platform. The rules are the same as the go tool's.
+func (p Platform) matchesFileName(filename string) bool {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(filename), ".go"), "_test")
+	i := strings.Index(name, "_")
+	if i == -1 {
+		return true
+	}
+	tags := p.platformTags()
+	matches := func(tag string) bool {
+		value, present := tags[tag]
+		return !present || value
+	}
+	l := strings.Split(name[i:], "_")
+	if n := len(l); n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+		return matches(l[n-2]) && matches(l[n-1])
+	} else if n >= 1 && (knownOS[l[n-1]] || knownArch[l[n-1]]) {
+		return matches(l[n-1])
+	}
+	return true
+}
+
+// knownOS and knownArch are the values of GOOS and GOARCH that Go recognises in build constraints.
+// These are taken from go/build/syslist.go.
+var knownOS = map[string]bool{
+	"aix":       true,
+	"android":   true,
+	"darwin":    true,
+	"dragonfly": true,
+	"freebsd":   true,
+	"hurd":      true,
+	"illumos":   true,
+	"ios":       true,
+	"js":        true,
+	"linux":     true,
+	"nacl":      true,
+	"netbsd":    true,
+	"openbsd":   true,
+	"plan9":     true,
+	"solaris":   true,
+	"wasip1":    true,
+	"windows":   true,
+	"zos":       true,
+}
+
+var unixOS = map[string]bool{
+	"aix":       true,
+	"android":   true,
+	"darwin":    true,
+	"dragonfly": true,
+	"freebsd":   true,
+	"hurd":      true,
+	"illumos":   true,
+	"ios":       true,
+	"linux":     true,
+	"netbsd":    true,
+	"openbsd":   true,
+	"solaris":   true,
+}
+
+var knownArch = map[string]bool{
+	"386":         true,
+	"amd64":       true,
+	"amd64p32":    true,
+	"arm":         true,
+	"armbe":       true,
+	"arm64":       true,
+	"arm64be":     true,
+	"loong64":     true,
+	"mips":        true,
+	"mipsle":      true,
+	"mips64":      true,
+	"mips64le":    true,
+	"mips64p32":   true,
+	"mips64p32le": true,
+	"ppc":         true,
+	"ppc64":       true,
+	"ppc64le":     true,
+	"riscv":       true,
+	"riscv64":     true,
+	"s390":        true,
+	"s390x":       true,
+	"sparc":       true,
+	"sparc64":     true,
+	"wasm":        true,
+}
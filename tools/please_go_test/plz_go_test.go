@@ -6,6 +6,8 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -16,13 +18,41 @@ import (
 var log = logging.MustGetLogger("plz_go_test")
 
 var opts struct {
-	Usage     string   `usage:"please_go_test is a code templater for Go tests.\n\nIt writes out the test main file required for each test, similar to what 'go test' does but as a separate tool that Please can invoke."`
-	Dir       string   `short:"d" long:"dir" description:"Directory to search for Go package files for coverage"`
-	Verbosity int      `short:"v" long:"verbose" default:"1" description:"Verbosity of output (higher number = more output, default 1 -> warnings and errors only)"`
-	Exclude   []string `short:"x" long:"exclude" default:"third_party/go" description:"Directories to exclude from search"`
-	Output    string   `short:"o" long:"output" description:"Output filename" required:"true"`
-	Package   string   `short:"p" long:"package" description:"Package containing this test" env:"PKG"`
-	Args      struct {
+	Usage             string       `usage:"please_go_test is a code templater for Go tests.\n\nIt writes out the test main file required for each test, similar to what 'go test' does but as a separate tool that Please can invoke."`
+	Dir               string       `short:"d" long:"dir" description:"Directory to search for Go package files for coverage"`
+	Verbosity         int          `short:"v" long:"verbose" default:"1" description:"Verbosity of output (higher number = more output, default 1 -> warnings and errors only)"`
+	Exclude           []string     `short:"x" long:"exclude" default:"third_party/go" description:"Directories to exclude from search. May be glob patterns."`
+	ExcludeFrom       string       `long:"exclude_from" description:"File to read further exclusions from, one per line"`
+	Instrument        []string     `short:"i" long:"instrument" description:"Source files to register coverage for. Defaults to all instrumented files found in --dir."`
+	CoverTests        bool         `long:"cover_tests" description:"Register coverage for the test sources as well, if they have been instrumented"`
+	Output            string       `short:"o" long:"output" description:"Output filename" required:"true"`
+	Package           string       `short:"p" long:"package" description:"Package containing this test" env:"PKG"`
+	Toolchain         string       `long:"toolchain" default:"local" description:"Value of GOTOOLCHAIN to set when invoking go"`
+	GoEnv             []string     `long:"go_env" description:"KEY=VALUE environment variable to set when invoking go. May be repeated."`
+	GoEnvFile         string       `long:"go_env_file" description:"File to read further KEY=VALUE environment variables for go from, one per line"`
+	TestImports       string       `long:"test_imports" description:"Also write the imports of the package's tests, as discovered by go list, to this file"`
+	Platforms         []string     `long:"platform" description:"Generate a separate test main for each of these os/arch pairs, with the tests that are built on it. Each output has the platform added to its name."`
+	Tags              []string     `long:"tags" description:"Build tag to consider set when deciding which test sources are built. May be repeated."`
+	ListTests         bool         `long:"list_tests" description:"Write a JSON description of each test function to the output file instead of a test main"`
+	Target            string       `long:"target" default:"gc" choice:"gc" choice:"tinygo" description:"Toolchain to generate the test main for"`
+	VerifyImports     bool         `long:"verify_imports" description:"Check that the package under test can be resolved by go list before generating the main"`
+	CoverOnly         bool         `long:"cover_only" description:"Generate a main that only registers coverage and exits, without running any tests"`
+	StructuredLogs    bool         `long:"structured_logs" description:"Also write the test output to $TEST_STRUCTURED_LOGS (or stderr) with each line prefixed by a timestamp and the name of the test that wrote it"`
+	Setup             string       `long:"setup" description:"Function to call before running the tests, if it exists and there is no TestMain"`
+	Teardown          string       `long:"teardown" description:"Function to call after running the tests, if it exists and there is no TestMain"`
+	GoMaxProcs        int          `long:"gomaxprocs" description:"Fix GOMAXPROCS to this value when running the tests"`
+	LeakCheck         bool         `long:"leak_check" description:"Fail if the tests leave goroutines running after they finish"`
+	LeakGracePeriod   cli.Duration `long:"leak_grace_period" default:"1s" description:"How long to wait for goroutines to exit before considering them leaked"`
+	AllocTests        bool         `long:"alloc_tests" description:"Run AllocTestXxx functions as tests that fail if they exceed the allocation budget in their //plz:allocs comment"`
+	MemStats          bool         `long:"memstats" description:"Record heap allocations made by each test and write them as JSON to $TEST_MEMSTATS_FILE"`
+	Retries           bool         `long:"retries" description:"Allow failed tests to be retried up to $TEST_RETRIES times, only failing if every attempt does"`
+	JSONOutput        bool         `long:"json_output" description:"Allow the tests to write their results as JSON events, like go test -json, when $TEST_OUTPUT is json"`
+	AsLibrary         string       `long:"as_library" description:"Generate a package of this name with an exported RunTests() int function instead of a main"`
+	CoverMode         string       `long:"cover_mode" choice:"set" choice:"count" choice:"atomic" description:"Mode to register coverage in; must match how the code was instrumented. Defaults to set, or atomic with --race."`
+	Race              bool         `long:"race" description:"Indicates the test is built with the race detector. Coverage is registered in atomic mode."`
+	Validate          bool         `long:"validate" description:"Check that the generated main is valid Go after writing it"`
+	ExitAfterTestMain bool         `long:"exit_after_test_main" description:"Exit with the test result if a TestMain function returns without calling os.Exit. Always on for Go 1.15 and later."`
+	Args              struct {
 		Go      string   `positional-arg-name:"go" description:"Location of go command" required:"true"`
 		Sources []string `positional-arg-name:"sources" description:"Test source files" required:"true"`
 	} `positional-args:"true" required:"true"`
@@ -31,11 +61,86 @@ var opts struct {
 func main() {
 	cli.ParseFlagsOrDie("plz_go_test", "7.2.0", &opts)
 	cli.InitLogging(opts.Verbosity)
-	coverVars, err := buildgo.FindCoverVars(opts.Dir, opts.Exclude, opts.Args.Sources)
+	buildgo.Toolchain = opts.Toolchain
+	buildgo.BuildTags = opts.Tags
+	goEnv, err := buildgo.ParseGoEnv(opts.GoEnv)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if opts.GoEnvFile != "" {
+		fileEnv, err := buildgo.ReadGoEnv(opts.GoEnvFile)
+		if err != nil {
+			log.Fatalf("Error reading go env: %s", err)
+		}
+		// Entries given directly on the command line take precedence.
+		goEnv = append(fileEnv, goEnv...)
+	}
+	buildgo.GoEnv = goEnv
+	if opts.ListTests {
+		listOpts := buildgo.TestMainOptions{Target: opts.Target, GoVersion: buildgo.DetectGoVersion(opts.Args.Go)}
+		if err := buildgo.WriteTestList(opts.Args.Sources, opts.Output, listOpts); err != nil {
+			log.Fatalf("Error writing test list: %s", err)
+		}
+		os.Exit(0)
+	}
+	if opts.TestImports != "" {
+		if err := buildgo.WriteTestImports(opts.Args.Go, filepath.Dir(opts.Args.Sources[0]), opts.TestImports); err != nil {
+			log.Fatalf("Error writing test imports: %s", err)
+		}
+	}
+	if opts.ExcludeFrom != "" {
+		excludes, err := buildgo.ReadExcludes(opts.ExcludeFrom)
+		if err != nil {
+			log.Fatalf("Error reading exclusions: %s", err)
+		}
+		opts.Exclude = append(opts.Exclude, excludes...)
+	}
+	// Test sources aren't normally instrumented so we don't look for cover vars in them.
+	srcs := opts.Args.Sources
+	if opts.CoverTests {
+		srcs = nil
+	}
+	coverVars, err := buildgo.FindCoverVars(opts.Dir, opts.Exclude, srcs)
 	if err != nil {
 		log.Fatalf("Error scanning for coverage: %s", err)
 	}
-	if err = buildgo.WriteTestMain(opts.Package, buildgo.IsVersion18(opts.Args.Go), opts.Args.Sources, opts.Output, coverVars); err != nil {
+	if len(opts.Instrument) > 0 {
+		coverVars = buildgo.FilterCoverVars(coverVars, opts.Instrument)
+	}
+	testMainOpts := buildgo.TestMainOptions{
+		Target:            opts.Target,
+		GoVersion:         buildgo.DetectGoVersion(opts.Args.Go),
+		GoTool:            opts.Args.Go,
+		VerifyImports:     opts.VerifyImports,
+		CoverOnly:         opts.CoverOnly,
+		StructuredLogs:    opts.StructuredLogs,
+		SetupFunction:     opts.Setup,
+		TeardownFunction:  opts.Teardown,
+		GoMaxProcs:        opts.GoMaxProcs,
+		LeakCheck:         opts.LeakCheck,
+		LeakGracePeriod:   time.Duration(opts.LeakGracePeriod),
+		AllocTests:        opts.AllocTests,
+		MemStats:          opts.MemStats,
+		Retries:           opts.Retries,
+		JSONOutput:        opts.JSONOutput,
+		LibraryPackage:    opts.AsLibrary,
+		CoverMode:         opts.CoverMode,
+		Race:              opts.Race,
+		Validate:          opts.Validate,
+		ExitAfterTestMain: opts.ExitAfterTestMain,
+	}
+	if len(opts.Platforms) > 0 {
+		platforms := make([]buildgo.Platform, len(opts.Platforms))
+		for i, p := range opts.Platforms {
+			if platforms[i], err = buildgo.ParsePlatform(p); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+		err = buildgo.WriteTestMains(opts.Package, opts.Args.Sources, opts.Output, platforms, coverVars, testMainOpts)
+	} else {
+		err = buildgo.WriteTestMain(opts.Package, opts.Args.Sources, opts.Output, coverVars, testMainOpts)
+	}
+	if err != nil {
 		log.Fatalf("Error writing test main: %s", err)
 	}
 	os.Exit(0)
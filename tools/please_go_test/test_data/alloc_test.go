@@ -0,0 +1,17 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its test allocates a lot of memory so it shows up in the memory stats.
+
+package alloc
+
+import "testing"
+
+var sink [][]byte
+
+func TestAllocates(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		sink = append(sink, make([]byte, 1024*1024))
+	}
+}
+
+func TestDoesNotAllocate(t *testing.T) {
+}
@@ -0,0 +1,12 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its allocation budgets parse as floats but aren't finite.
+
+package allocs
+
+//plz:allocs Inf
+func AllocTestInfinite() {
+}
+
+//plz:allocs NaN
+func AllocTestNaN() {
+}
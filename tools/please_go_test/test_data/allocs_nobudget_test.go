@@ -0,0 +1,7 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its allocation test doesn't declare a budget.
+
+package allocs
+
+func AllocTestNoBudget() {
+}
@@ -0,0 +1,18 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It has allocation tests, one of which exceeds its budget.
+
+package allocs
+
+var sink []byte
+
+//plz:allocs 0
+func AllocTestWithinBudget() {
+	sink = sink[:0]
+}
+
+// AllocTestOverBudget allocates on every run.
+//
+//plz:allocs 0.5
+func AllocTestOverBudget() {
+	sink = make([]byte, 64)
+}
@@ -0,0 +1,26 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It has benchmarks alongside a test.
+
+package bench
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	if sum(1, 2) != 3 {
+		t.Fatal("wrong sum")
+	}
+}
+
+func BenchmarkSum(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sum(i, i)
+	}
+}
+
+// BenchmarkWrongSignature isn't a benchmark since it doesn't take a *testing.B.
+func BenchmarkWrongSignature(t *testing.T) {
+}
+
+func sum(a, b int) int {
+	return a + b
+}
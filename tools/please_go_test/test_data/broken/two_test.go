@@ -0,0 +1,7 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It doesn't parse.
+
+package broken
+
+func TestAlsoBroken(t *testing.T {
+}
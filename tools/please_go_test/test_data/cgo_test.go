@@ -0,0 +1,12 @@
+//go:build cgo
+// +build cgo
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It should only be included when cgo is enabled.
+
+package buildgo
+
+import "testing"
+
+func TestCgo(t *testing.T) {
+}
@@ -0,0 +1,17 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It declares the same functions as internal_test.go, in the external test package.
+
+package dup_test
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSame(t *testing.T) {
+	fmt.Println("external TestSame")
+}
+
+func TestMainSetup() {
+	fmt.Println("external setup")
+}
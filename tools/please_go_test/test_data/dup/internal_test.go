@@ -0,0 +1,17 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It declares the same functions as external_test.go, which go test allows since they're in different packages.
+
+package dup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSame(t *testing.T) {
+	fmt.Println("internal TestSame")
+}
+
+func TestMainSetup() {
+	fmt.Println("internal setup")
+}
@@ -0,0 +1,29 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It has examples with and without output comments.
+
+package output
+
+import "fmt"
+
+func ExampleHello() {
+	fmt.Println("hello")
+	// Output: hello
+}
+
+func ExampleUnordered() {
+	fmt.Println("b")
+	fmt.Println("a")
+	// Unordered output:
+	// a
+	// b
+}
+
+// ExampleNoOutput has no output comment so is only compiled.
+func ExampleNoOutput() {
+	fmt.Println("not checked")
+}
+
+func ExampleWrong() {
+	fmt.Println("goodbye")
+	// Output: hello
+}
@@ -0,0 +1,20 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It has a TestMain that exits as soon as the tests finish, and a test that writes a lot of output.
+
+package exitmain
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
+
+func TestLotsOfOutput(t *testing.T) {
+	for i := 1; i <= 2000; i++ {
+		fmt.Printf("line %d\n", i)
+	}
+}
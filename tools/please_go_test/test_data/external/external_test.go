@@ -0,0 +1,17 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's in the external test package, alongside internal_test.go which isn't.
+
+package external_test
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExternal(t *testing.T) {
+}
+
+func ExampleExternal() {
+	fmt.Println("hello")
+	// Output: hello
+}
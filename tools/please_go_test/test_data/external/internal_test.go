@@ -0,0 +1,9 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's in the package under test, alongside external_test.go which isn't.
+
+package external
+
+import "testing"
+
+func TestInternal(t *testing.T) {
+}
@@ -0,0 +1,13 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It defines a TestMain in the external test package.
+
+package external_test
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
@@ -0,0 +1,27 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its first test fails until it's been run three times; the second never passes and the third panics.
+
+package flaky
+
+import (
+	"fmt"
+	"testing"
+)
+
+var runs int
+
+func TestFlaky(t *testing.T) {
+	runs++
+	if runs < 3 {
+		t.Fatalf("Failed on run %d", runs)
+	}
+}
+
+func TestAlwaysFails(t *testing.T) {
+	t.Error("Failed again")
+}
+
+func TestPanics(t *testing.T) {
+	fmt.Println("About to panic")
+	panic("oh no")
+}
@@ -0,0 +1,24 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It has a fuzz target with a seed corpus.
+
+package fuzz
+
+import "testing"
+
+func FuzzReverse(f *testing.F) {
+	f.Add("hello")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, s string) {
+		if reverse(reverse(s)) != s {
+			t.Errorf("reversing %q twice gave something else", s)
+		}
+	})
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,13 @@
+//go:build ignore
+// +build ignore
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's tagged as ignored so its tests should never be included in a test main.
+
+package main
+
+import "testing"
+
+func TestIgnored(t *testing.T) {
+	t.Fatal("this should never be run")
+}
@@ -0,0 +1,29 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's been instrumented by go tool cover in count mode.
+
+//line count.go:1:1
+package instrumented
+
+func Add(a, b int) int {GoCover_count_go.Count[0]++;
+	if a > 0 {GoCover_count_go.Count[2]++;
+		return a + b
+	}
+	GoCover_count_go.Count[1]++;return b
+}
+
+var GoCover_count_go = struct {
+	Count     [3]uint32
+	Pos       [3 * 3]uint32
+	NumStmt   [3]uint16
+} {
+	Pos: [3 * 3]uint32{
+		4, 4, 0xb0002, // [0]
+		7, 7, 0xa0002, // [1]
+		5, 6, 0x10003, // [2]
+	},
+	NumStmt: [3]uint16{
+		1, // 0
+		1, // 1
+		1, // 2
+	},
+}
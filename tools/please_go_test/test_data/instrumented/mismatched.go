@@ -0,0 +1,22 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its coverage arrays don't agree with each other, as if it had been instrumented twice.
+
+//line mismatched.go:1:1
+package instrumented
+
+func Sub(a, b int) int {GoCover_mismatched_go.Count[0]++;
+	return a - b
+}
+
+var GoCover_mismatched_go = struct {
+	Count     [2]uint32
+	Pos       [3 * 1]uint32
+	NumStmt   [1]uint16
+} {
+	Pos: [3 * 1]uint32{
+		4, 6, 0x20018, // [0]
+	},
+	NumStmt: [1]uint16{
+		1, // 0
+	},
+}
@@ -0,0 +1,14 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its test leaves a goroutine running after it finishes.
+
+package leaky
+
+import "testing"
+
+var block = make(chan struct{})
+
+func TestLeaksGoroutine(t *testing.T) {
+	go func() {
+		<-block
+	}()
+}
@@ -0,0 +1,16 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Only one of these functions is a valid test.
+
+package buildgo
+
+import "testing"
+
+func TestValid(t *testing.T) {
+}
+
+func TestHelper(foo int) {
+}
+
+func TestReturnsError(t *testing.T) error {
+	return nil
+}
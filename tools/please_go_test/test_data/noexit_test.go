@@ -0,0 +1,14 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its TestMain forgets to call os.Exit with the result of m.Run().
+
+package noexit
+
+import "testing"
+
+func TestMain(m *testing.M) {
+	m.Run()
+}
+
+func TestFails(t *testing.T) {
+	t.Fatal("this should make the test binary exit non-zero")
+}
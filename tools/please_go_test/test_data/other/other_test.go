@@ -0,0 +1,9 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It lives in a different directory to the other test sources.
+
+package other
+
+import "testing"
+
+func TestOther(t *testing.T) {
+}
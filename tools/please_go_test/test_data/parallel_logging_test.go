@@ -0,0 +1,25 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its tests run in parallel and log as they go, which interleaves their output.
+
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogsInParallel1(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 5; i++ {
+		t.Logf("first test, iteration %d", i)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLogsInParallel2(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 5; i++ {
+		t.Logf("second test, iteration %d", i)
+		time.Sleep(time.Millisecond)
+	}
+}
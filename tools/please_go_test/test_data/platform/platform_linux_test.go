@@ -0,0 +1,9 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its filename restricts it to Linux.
+
+package platform
+
+import "testing"
+
+func TestLinux(t *testing.T) {
+}
@@ -0,0 +1,9 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its tests are run on all platforms.
+
+package platform
+
+import "testing"
+
+func TestAllPlatforms(t *testing.T) {
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its build constraint restricts it to Windows.
+
+package platform
+
+import "testing"
+
+func TestWindows(t *testing.T) {
+}
@@ -0,0 +1,11 @@
+//go:build go1.21
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's only built by Go 1.21 and later.
+
+package buildgo
+
+import "testing"
+
+func TestGo121(t *testing.T) {
+}
@@ -0,0 +1,11 @@
+//go:build !go1.21
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's only built by versions of Go before 1.21.
+
+package buildgo
+
+import "testing"
+
+func TestBeforeGo121(t *testing.T) {
+}
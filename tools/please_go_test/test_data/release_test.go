@@ -0,0 +1,12 @@
+//go:build go1.1 && gc
+// +build go1.1,gc
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// Its build constraint needs the release and compiler tags, which are set for gc.
+
+package buildgo
+
+import "testing"
+
+func TestGo11(t *testing.T) {
+}
@@ -0,0 +1,22 @@
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It uses setup & teardown functions instead of a TestMain.
+
+package setup
+
+import "testing"
+
+var setUp bool
+
+func TestMainSetup() {
+	setUp = true
+}
+
+func TestMainTeardown() {
+	setUp = false
+}
+
+func TestIsSetUp(t *testing.T) {
+	if !setUp {
+		t.Fatal("TestMainSetup should have been called before running tests")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !integration
+// +build !integration
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's excluded when the integration tag is set.
+
+package buildgo
+
+import "testing"
+
+func TestNotIntegration(t *testing.T) {
+}
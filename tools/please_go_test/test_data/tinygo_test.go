@@ -0,0 +1,11 @@
+//go:build tinygo
+
+// This isn't a 'real' source file, it's test data for //tools/please_go_test:write_test_main_test
+// It's only built by TinyGo.
+
+package buildgo
+
+import "testing"
+
+func TestTinyGo(t *testing.T) {
+}
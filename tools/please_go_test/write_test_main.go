@@ -1,121 +1,950 @@
 package buildgo
 
 import (
+	"encoding/json"
 	"fmt"
 	"go/ast"
+	"go/build/constraint"
+	"go/constant"
+	"go/doc"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
 type testDescr struct {
-	Package   string
-	Main      string
-	Functions []string
-	CoverVars []CoverVar
-	Imports   []string
-	Version18 bool
+	TestMainOptions
+	Package    string
+	Main       function
+	Functions  []function
+	Benchmarks []function
+	Fuzz       []function
+	Examples   []example
+	Files      map[function]string // Maps test functions to the file they're defined in.
+	Setup      function
+	Teardown   function
+	// All top-level functions that take no arguments and return nothing.
+	plainFunctions map[function]bool
+	AllocTests     []allocTest
+	CoverVars      []CoverVar
+	Imports        []string
+	TinyGo         bool
+	// CoveredPackages describes the packages coverage is registered for, in the form testing expects.
+	CoveredPackages string
+	// WrapTests is true if each test function is wrapped to do extra work around it.
+	WrapTests bool
+	// PackagePath is the import path of the package under test, which is reported in JSON events.
+	PackagePath string
+	// Exit is how the generated code exits with a status; os.Exit for a main, or return for a library.
+	Exit string
+	// XPackage is the name of the external test package (e.g. foo_test), if there are any sources in it.
+	XPackage string
+}
+
+// A function is a top-level function in the test sources. Its name alone doesn't identify it, since
+// the package under test and the external test package can each declare one with the same name.
+type function struct {
+	Name string
+	// External is true if it's declared in the external test package.
+	External bool
+}
+
+// An example is an ExampleXxx function whose output is checked.
+type example struct {
+	Name      string
+	External  bool
+	Output    string
+	Unordered bool
+}
+
+// An allocTest is a function whose allocations are checked against a budget.
+type allocTest struct {
+	Name     string
+	External bool
+	Budget   string // Maximum allocations per run, from its //plz:allocs comment.
+}
+
+// TestMainOptions are optional settings controlling how the test main is generated.
+// The zero value generates a main for the standard gc toolchain.
+type TestMainOptions struct {
+	// Target is the toolchain the main is generated for; either "gc" (the default) or "tinygo".
+	Target string
+	// GoVersion is the version of the toolchain, which decides which features of testing the main can use.
+	// It isn't taken from the go directive in go.mod; that only sets the language version, whereas the
+	// MainStart signature and the rest of the testing API are whatever the toolchain provides.
+	GoVersion GoVersion
+	// GoTool is the location of the go tool, used for any checks that need to invoke it.
+	GoTool string
+	// VerifyImports checks that the package under test can be resolved before generating anything.
+	VerifyImports bool
+	// CoverOnly generates a main that registers coverage and exits without running any tests.
+	CoverOnly bool
+	// StructuredLogs writes a copy of the test output with each line prefixed by a timestamp and the
+	// test it came from, to $TEST_STRUCTURED_LOGS or stderr. The output on stdout isn't changed.
+	// Like JSONOutput it works by running the binary again, with the same restrictions.
+	StructuredLogs bool
+	// SetupFunction and TeardownFunction name functions that are called before and after running
+	// the tests, if they're defined and there is no TestMain.
+	SetupFunction, TeardownFunction string
+	// GoMaxProcs sets GOMAXPROCS to a fixed value before running tests, if it's greater than zero.
+	GoMaxProcs int
+	// LeakCheck fails the run if there are more goroutines once the tests finish than before they
+	// started, after waiting up to LeakGracePeriod for them to exit. It can't be applied to a TestMain.
+	LeakCheck       bool
+	LeakGracePeriod time.Duration
+	// LibraryPackage generates a package of this name with an exported RunTests() int function
+	// instead of a main package, so the tests can be driven programmatically.
+	LibraryPackage string
+	// AllocTests runs functions named AllocTestXxx as tests that fail if they make more allocations
+	// per run than the budget given by a //plz:allocs N comment on them.
+	AllocTests bool
+	// MemStats records the heap allocations made during each test and writes them as JSON
+	// to $TEST_MEMSTATS_FILE (or stderr) after the tests have run. It can't be applied to a TestMain.
+	MemStats bool
+	// Retries allows failed tests to be retried up to $TEST_RETRIES times; they only fail if every attempt does.
+	// When it's set, tests run one at a time, and each attempt runs as often as -test.count and -test.cpu ask.
+	Retries bool
+	// JSONOutput allows the tests to write their results as JSON events, like go test -json, when
+	// $TEST_OUTPUT is "json". It works by running the binary again, so needs Go 1.12 or later and
+	// can't be used with TinyGo or a library package.
+	JSONOutput bool
+	// CoverMode is the mode coverage is registered in; "set", "count" or "atomic". It has to match the
+	// mode the code was instrumented in. It defaults to "set", or "atomic" if Race is true.
+	CoverMode string
+	// Race indicates the test is built with the race detector, which requires atomic coverage counters.
+	Race bool
+	// Validate checks the generated main is valid Go after writing it.
+	Validate bool
+	// ExitAfterTestMain makes the main exit with the tests' result if a user-defined TestMain
+	// returns without calling os.Exit itself. It's always done for Go 1.15 and later, like go test does.
+	ExitAfterTestMain bool
 }
 
 // WriteTestMain templates a test main file from the given sources to the given output file.
-// This mimics what 'go test' does, although we do not currently support benchmarks or examples.
-func WriteTestMain(pkgDir string, version18 bool, sources []string, output string, coverVars []CoverVar) error {
-	testDescr, err := parseTestSources(sources)
-	if err != nil {
+// This mimics what 'go test' does.
+func WriteTestMain(pkgDir string, sources []string, output string, coverVars []CoverVar, opts TestMainOptions) error {
+	if err := checkSourceDirs(sources); err != nil {
 		return err
 	}
-	testDescr.CoverVars = coverVars
-	testDescr.Version18 = version18
-	if len(testDescr.Functions) > 0 {
-		// Can't set this if there are no test functions, it'll be an unused import.
-		testDescr.Imports = extraImportPaths(testDescr.Package, pkgDir, coverVars)
+	testDescr, err := parseTestSources(sources, opts)
+	if err != nil {
+		return err
 	}
+	return writeTestMain(pkgDir, testDescr, output, coverVars, opts)
+}
 
-	f, err := os.Create(output)
+// WriteTestMains is like WriteTestMain but writes a separate test main for each of the given platforms,
+// each with only the tests whose build constraints are satisfied on it. The sources are only parsed once.
+// Each output is named by inserting the platform before the extension, e.g. main_linux_amd64.go.
+func WriteTestMains(pkgDir string, sources []string, output string, platforms []Platform, coverVars []CoverVar, opts TestMainOptions) error {
+	if err := checkSourceDirs(sources); err != nil {
+		return err
+	}
+	files, err := parseFiles(sources)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	ext := filepath.Ext(output)
+	for _, platform := range platforms {
+		out := strings.TrimSuffix(output, ext) + "_" + platform.String() + ext
+		descr, err := describeTestSources(files, platform, opts)
+		if err != nil {
+			return err
+		} else if err := writeTestMain(pkgDir, descr, out, coverVars, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTestMain(pkgDir string, testDescr testDescr, output string, coverVars []CoverVar, opts TestMainOptions) error {
+	testDescr.TestMainOptions = opts
+	testDescr.CoverVars = coverVars
+	testDescr.CoveredPackages = coveredPackages(coverVars)
+	testDescr.Exit = "os.Exit"
+	if opts.LibraryPackage != "" {
+		testDescr.Exit = "return"
+		// RunTests has to return a result, so TestMain can't be allowed to end the process.
+		testDescr.ExitAfterTestMain = true
+	}
+	switch opts.CoverMode {
+	case "":
+		testDescr.CoverMode = "set"
+		if opts.Race {
+			// Counters are updated concurrently under the race detector so must be read atomically.
+			testDescr.CoverMode = "atomic"
+		}
+	case "set", "count":
+		if opts.Race {
+			return fmt.Errorf("Coverage mode must be atomic when using the race detector, not %s", opts.CoverMode)
+		}
+	case "atomic":
+	default:
+		return fmt.Errorf("Unknown coverage mode %s", opts.CoverMode)
+	}
+	for _, v := range coverVars {
+		if mode := detectCoverMode(v.File, v.Var); mode != "" && mode != testDescr.CoverMode {
+			return fmt.Errorf("%s was instrumented in %s mode but coverage is being registered in %s mode", v.File, mode, testDescr.CoverMode)
+		} else if err := checkCoverSizes(v.File, v.Var); err != nil {
+			return err
+		}
+	}
+	switch opts.Target {
+	case "", "gc":
+	case "tinygo":
+		// TinyGo's testing package has no coverage support and no testdeps package.
+		if len(coverVars) > 0 {
+			return fmt.Errorf("Coverage is not supported when targeting TinyGo")
+		}
+		testDescr.TinyGo = true
+		testDescr.GoVersion = GoVersion{}
+	default:
+		return fmt.Errorf("Unknown target toolchain %s", opts.Target)
+	}
+	if opts.VerifyImports {
+		if err := verifyImport(opts.GoTool, packageImportPath(testDescr.Package, pkgDir)); err != nil {
+			return err
+		}
+	}
+	if err := findSetupAndTeardown(&testDescr, opts.SetupFunction, opts.TeardownFunction); err != nil {
+		return err
+	}
+	// From 1.15 m.Run() records its result, so we can always tell if the tests failed when TestMain returns.
+	// Before that it's opt-in because we'd have to assume they did.
+	if testDescr.GoVersion.AtLeast(15) {
+		testDescr.ExitAfterTestMain = true
+	}
+	if testDescr.LeakCheck && testDescr.Main.Name != "" {
+		log.Warning("%s defines %s, goroutine leaks can't be checked", testDescr.Package, testDescr.Main.Name)
+		testDescr.LeakCheck = false
+	}
+	if testDescr.MemStats && testDescr.Main.Name != "" {
+		// TestMain normally ends with os.Exit, so we'd never get the chance to write them.
+		log.Warning("%s defines %s, memory stats can't be reported", testDescr.Package, testDescr.Main.Name)
+		testDescr.MemStats = false
+	}
+	if testDescr.Retries && testDescr.TinyGo {
+		log.Warning("Tests can't be retried with TinyGo")
+		testDescr.Retries = false
+	}
+	if testDescr.StructuredLogs && (testDescr.TinyGo || opts.LibraryPackage != "") {
+		log.Warning("Structured logs aren't available with TinyGo or as a library")
+		testDescr.StructuredLogs = false
+	} else if testDescr.StructuredLogs && !testDescr.GoVersion.AtLeast(12) {
+		log.Warning("Structured logs need Go 1.12 or later")
+		testDescr.StructuredLogs = false
+	}
+	if testDescr.JSONOutput && (testDescr.TinyGo || opts.LibraryPackage != "") {
+		log.Warning("JSON output isn't available with TinyGo or as a library")
+		testDescr.JSONOutput = false
+	} else if testDescr.JSONOutput && !testDescr.GoVersion.AtLeast(12) {
+		log.Warning("JSON output needs Go 1.12 or later")
+		testDescr.JSONOutput = false
+	}
+	if len(testDescr.Fuzz) > 0 && !testDescr.GoVersion.AtLeast(18) && !testDescr.TinyGo {
+		log.Warning("Fuzz targets need Go 1.18 or later, they won't be run")
+		testDescr.Fuzz = nil
+	}
+	if !opts.AllocTests {
+		testDescr.AllocTests = nil
+	}
+	for _, test := range testDescr.AllocTests {
+		if test.Budget == "" {
+			return fmt.Errorf("%s has no allocation budget, it needs a //plz:allocs comment", test.Name)
+		} else if budget, err := strconv.ParseFloat(test.Budget, 64); err != nil {
+			return fmt.Errorf("Invalid allocation budget for %s: %s", test.Name, err)
+		} else if math.IsInf(budget, 0) || math.IsNaN(budget) {
+			return fmt.Errorf("Invalid allocation budget for %s: %s isn't a finite number", test.Name, test.Budget)
+		}
+	}
+	if opts.CoverOnly {
+		if len(coverVars) == 0 {
+			return fmt.Errorf("Can't generate a coverage-only main without any coverage variables")
+		}
+		// Nothing from the package under test is run, so don't import it at all.
+		testDescr.Main = function{}
+		testDescr.Setup = function{}
+		testDescr.Teardown = function{}
+		testDescr.Functions = nil
+		testDescr.Benchmarks = nil
+		testDescr.Fuzz = nil
+		testDescr.Examples = nil
+		testDescr.AllocTests = nil
+		testDescr.ExitAfterTestMain = false
+		testDescr.LeakCheck = false
+		testDescr.MemStats = false
+		testDescr.GoMaxProcs = 0
+		testDescr.Imports = coverImportPaths(coverVars)
+	} else if testDescr.usesPackage(false) || testDescr.usesPackage(true) {
+		// Can't set this if nothing refers to the package, it'll be an unused import.
+		testDescr.Imports = extraImportPaths(&testDescr, pkgDir, coverVars)
+	}
+	testDescr.WrapTests = testDescr.MemStats || testDescr.Retries
+	testDescr.PackagePath = packageImportPath(testDescr.Package, pkgDir)
+
+	if err := os.MkdirAll(filepath.Dir(output), os.ModeDir|0775); err != nil {
+		return fmt.Errorf("Can't create output directory for %s: %s", output, err)
+	}
 	// This might be consumed by other things.
 	fmt.Printf("Package: %s\n", testDescr.Package)
-	return testMainTmpl.Execute(f, testDescr)
+	if testDescr.usesPackage(true) {
+		// The external tests are compiled separately, and the build rules need to know what to call them.
+		fmt.Printf("XPackage: %s\n", testDescr.XPackage)
+	}
+	return writeAtomically(output, func(f *os.File) error {
+		if err := testMainTmpl.Execute(f, testDescr); err != nil {
+			return err
+		} else if opts.Validate {
+			return validateTestMain(f.Name())
+		}
+		return nil
+	})
+}
+
+// writeAtomically writes a file by calling the given function on a temporary file, which is
+// renamed to the output once it succeeds. On failure any existing output is left untouched.
+func writeAtomically(output string, write func(f *os.File) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly once it's been renamed.
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), output)
+}
+
+// validateTestMain checks that the given generated file is valid Go and that everything it refers to is defined.
+// It doesn't type check the file (which would need all its dependencies) so it's not exhaustive.
+func validateTestMain(filename string) error {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		return fmt.Errorf("Generated test main is invalid, this is probably a bug in the template: %s", err)
+	}
+	imports := map[string]bool{}
+	for _, imp := range f.Imports {
+		if imp.Name != nil {
+			imports[imp.Name.Name] = true
+		} else if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+			imports[path.Base(p)] = true
+		}
+	}
+	for _, ident := range f.Unresolved {
+		if !imports[ident.Name] && types.Universe.Lookup(ident.Name) == nil {
+			return fmt.Errorf("Generated test main %s refers to undefined name %s, this is probably a bug in the template", filename, ident.Name)
+		}
+	}
+	return nil
+}
+
+// A TestFunction describes a single test function, for example so that a separate target can be created to run it.
+type TestFunction struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Filter is a value for $TESTS that runs only this test.
+	Filter string `json:"filter"`
+}
+
+// WriteTestList writes a JSON description of each test function in the given sources to the given output file.
+// They're ordered by filename and then by their position in the file, regardless of the order of sources.
+// The target toolchain and Go version in opts decide which sources are built.
+func WriteTestList(sources []string, output string, opts TestMainOptions) error {
+	descr, err := parseTestSources(sources, opts)
+	if err != nil {
+		return err
+	}
+	functions := make([]TestFunction, len(descr.Functions))
+	for i, fn := range descr.Functions {
+		functions[i] = TestFunction{
+			Name:   fn.Name,
+			File:   descr.Files[fn],
+			Filter: "^" + fn.Name + "$",
+		}
+	}
+	b, err := json.MarshalIndent(functions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, b, 0644)
+}
+
+// WriteTestImports writes a JSON list of the imports of the test sources of the package in the given
+// directory, as discovered by go list, to the given output file.
+func WriteTestImports(goTool, dir, output string) error {
+	cmd := goCommand(goTool, "list", "-json", ".")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Can't list test imports of %s: %s", dir, err)
+	}
+	imports, err := parseTestImports(out)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(imports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, b, 0644)
+}
+
+// parseTestImports returns the combined, sorted test imports from the output of go list -json.
+func parseTestImports(listOutput []byte) ([]string, error) {
+	pkg := struct {
+		ImportPath   string
+		TestImports  []string
+		XTestImports []string
+	}{}
+	if err := json.Unmarshal(listOutput, &pkg); err != nil {
+		return nil, fmt.Errorf("Can't parse go list output: %s", err)
+	}
+	imports := []string{}
+	seen := map[string]bool{}
+	for _, imp := range append(pkg.TestImports, pkg.XTestImports...) {
+		// The external test package imports the package under test, which isn't a dependency.
+		if !seen[imp] && imp != pkg.ImportPath {
+			seen[imp] = true
+			imports = append(imports, imp)
+		}
+	}
+	sort.Strings(imports)
+	return imports, nil
+}
+
+// A GoVersion is the version of a Go toolchain. Only the major and minor versions matter to us.
+type GoVersion struct {
+	Major, Minor int
+}
+
+// AtLeast returns true if this is at least version 1.minor.
+func (v GoVersion) AtLeast(minor int) bool {
+	return v.Major > 1 || (v.Major == 1 && v.Minor >= minor)
+}
+
+// develVersion is what we assume a development build of Go to be; it's newer than any release.
+var develVersion = GoVersion{Major: 1, Minor: math.MaxInt32}
+
+// goVersions caches the result of DetectGoVersion for each go tool, keyed by its absolute path.
+var goVersions = struct {
+	sync.Mutex
+	entries map[string]*cachedGoVersion
+}{entries: map[string]*cachedGoVersion{}}
+
+type cachedGoVersion struct {
+	once    sync.Once
+	version GoVersion
+}
+
+// DetectGoVersion returns the version of the given Go tool.
+// It's only run once for each tool; concurrent callers wait for and share the same result.
+func DetectGoVersion(goTool string) GoVersion {
+	key := goTool
+	if abs, err := filepath.Abs(goTool); err == nil {
+		key = abs
+	}
+	goVersions.Lock()
+	entry, present := goVersions.entries[key]
+	if !present {
+		entry = &cachedGoVersion{}
+		goVersions.entries[key] = entry
+	}
+	goVersions.Unlock()
+	entry.once.Do(func() {
+		entry.version = detectGoVersion(goTool)
+	})
+	return entry.version
+}
+
+// detectGoVersion runs the given Go tool to find its version.
+func detectGoVersion(goTool string) GoVersion {
+	out, err := goCommand(goTool, "version").Output()
+	if err != nil {
+		log.Fatalf("Can't determine Go version: %s", err)
+	}
+	return parseGoVersion(out)
 }
 
 // IsVersion18 returns true if the given Go tool is version 1.8 or greater.
 // This is needed because the test main signature has changed - it's not subject to the Go1 compatibility guarantee :(
 func IsVersion18(goTool string) bool {
-	cmd := exec.Command(goTool, "version")
-	out, err := cmd.Output()
+	return DetectGoVersion(goTool).AtLeast(8)
+}
+
+// Toolchain is the value of GOTOOLCHAIN that we set when invoking the go tool.
+// It defaults to "local" so that newer versions of Go don't download a different toolchain behind our back.
+var Toolchain = "local"
+
+// GoEnv is a set of KEY=VALUE environment variables applied to every invocation of the go tool,
+// on top of our own environment. They take precedence over anything else we set.
+var GoEnv []string
+
+// ParseGoEnv checks that the given entries are all in the form KEY=VALUE.
+func ParseGoEnv(entries []string) ([]string, error) {
+	for _, entry := range entries {
+		if idx := strings.IndexByte(entry, '='); idx < 1 {
+			return nil, fmt.Errorf("Invalid go env entry %s, should be in the form KEY=VALUE", entry)
+		}
+	}
+	return entries, nil
+}
+
+// ReadGoEnv reads a set of KEY=VALUE environment variables from the given file, one per line.
+// Blank lines and lines beginning with a # are ignored.
+func ReadGoEnv(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("Can't determine Go version: %s", err)
+		return nil, err
+	}
+	entries := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
 	}
-	return isVersion18(out)
+	return ParseGoEnv(entries)
 }
 
-func isVersion18(version []byte) bool {
-	r := regexp.MustCompile("go version go1.([0-9]+)[^0-9].*")
-	m := r.FindSubmatch(version)
-	if len(m) == 0 {
-		log.Warning("Failed to match %s", version)
-		return false
+// goCommand returns a command that invokes the given go tool with the given arguments.
+func goCommand(goTool string, args ...string) *exec.Cmd {
+	cmd := exec.Command(goTool, args...)
+	cmd.Env = append(append(os.Environ(), "GOTOOLCHAIN="+Toolchain), GoEnv...)
+	return cmd
+}
+
+// parseGoVersion parses the output of go version. Release versions can have a patch version or
+// a beta / rc suffix, which are ignored. Development builds are assumed to support everything.
+func parseGoVersion(version []byte) GoVersion {
+	if m := goVersionRegex.FindSubmatch(version); m != nil {
+		major, _ := strconv.Atoi(string(m[1]))
+		minor, _ := strconv.Atoi(string(m[2]))
+		return GoVersion{Major: major, Minor: minor}
+	} else if strings.HasPrefix(string(version), "go version devel") {
+		return develVersion
 	}
-	v, _ := strconv.Atoi(string(m[1]))
-	return v >= 8
+	log.Warning("Failed to match %s", version)
+	return GoVersion{}
+}
+
+var goVersionRegex = regexp.MustCompile(`^go version (?:devel )?go([0-9]+)\.([0-9]+)(?:[^0-9]|$)`)
+
+// verifyImport checks that the go tool can resolve the given import path.
+func verifyImport(goTool, importPath string) error {
+	if out, err := goCommand(goTool, "list", importPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("Can't resolve import path %s for the package under test: %s\n%s", importPath, err, out)
+	}
+	return nil
+}
+
+// packageImportPath returns the import path of the package under test.
+func packageImportPath(pkg, pkgDir string) string {
+	return collapseFinalDir(path.Join(strings.TrimPrefix(toSlash(pkgDir), "src/"), pkg))
 }
 
 // extraImportPaths returns the set of extra import paths that are needed.
-func extraImportPaths(pkg, pkgDir string, coverVars []CoverVar) []string {
-	pkgDir = collapseFinalDir(path.Join(strings.TrimPrefix(pkgDir, "src/"), pkg))
-	ret := []string{fmt.Sprintf("%s \"%s\"", pkg, pkgDir)}
+func extraImportPaths(descr *testDescr, pkgDir string, coverVars []CoverVar) []string {
+	importPath := packageImportPath(descr.Package, pkgDir)
+	name := descr.Package
+	if !descr.usesPackage(false) {
+		// Like go test, we still import the package under test even if only the external tests refer to it.
+		name = "_"
+	}
+	ret := []string{fmt.Sprintf("%s \"%s\"", name, importPath)}
+	if descr.usesPackage(true) {
+		ret = append(ret, fmt.Sprintf("%s \"%s_test\"", descr.XPackage, importPath))
+	}
+	return append(ret, coverImportPaths(coverVars)...)
+}
+
+// coverImportPaths returns the import paths needed for the given cover vars, and sets their import names.
+func coverImportPaths(coverVars []CoverVar) []string {
+	ret := []string{}
+	seen := map[string]bool{}
 	for i, v := range coverVars {
-		name := fmt.Sprintf("_cover%d", i)
+		name := coverImportName(v.ImportPath)
 		coverVars[i].ImportName = name
-		ret = append(ret, fmt.Sprintf("%s \"%s\"", name, v.ImportPath))
+		if !seen[name] {
+			seen[name] = true
+			ret = append(ret, fmt.Sprintf("%s \"%s\"", name, v.ImportPath))
+		}
 	}
 	return ret
 }
 
-// parseTestSources parses the test sources and returns the package and set of test functions in them.
-func parseTestSources(sources []string) (testDescr, error) {
-	descr := testDescr{}
+// coveredPackages returns the distinct import paths of the given cover vars, sorted and comma-separated.
+// Like go test it's prefixed with " in " since testing appends it to its coverage summary.
+func coveredPackages(coverVars []CoverVar) string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, v := range coverVars {
+		if !seen[v.ImportPath] {
+			seen[v.ImportPath] = true
+			paths = append(paths, v.ImportPath)
+		}
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+	return " in " + strings.Join(paths, ", ")
+}
+
+// coverImportName returns the alias we import a covered package under.
+// It's derived only from the import path so the generated main is identical between runs.
+func coverImportName(importPath string) string {
+	h := fnv.New64a()
+	h.Write([]byte(importPath))
+	return fmt.Sprintf("_cover%016x", h.Sum64())
+}
+
+// detectCoverMode returns the mode that the given file was instrumented in by go tool cover,
+// or the empty string if it can't be determined (e.g. the file isn't instrumented or doesn't exist).
+func detectCoverMode(filename, coverVar string) string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	v := regexp.QuoteMeta(coverVar)
+	if regexp.MustCompile(`AddUint32\(&` + v + `\.Count\[`).Match(b) {
+		return "atomic"
+	} else if regexp.MustCompile(v + `\.Count\[[0-9]+\]\+\+`).Match(b) {
+		return "count"
+	} else if regexp.MustCompile(v + `\.Count\[[0-9]+\] = 1`).Match(b) {
+		return "set"
+	}
+	return ""
+}
+
+// checkCoverSizes checks that the counter, position and statement count arrays of the given cover variable
+// have consistent sizes, as they will if they came from a single run of go tool cover.
+// If the variable can't be found (e.g. the file isn't instrumented or doesn't exist) it isn't checked.
+func checkCoverSizes(filename, coverVar string) error {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		return nil
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if len(vs.Names) != 1 || vs.Names[0].Name != coverVar || len(vs.Values) != 1 {
+				continue
+			}
+			lit, ok := vs.Values[0].(*ast.CompositeLit)
+			if !ok {
+				return nil
+			}
+			st, ok := lit.Type.(*ast.StructType)
+			if !ok {
+				return nil
+			}
+			sizes := map[string]int64{}
+			for _, field := range st.Fields.List {
+				if at, ok := field.Type.(*ast.ArrayType); ok && at.Len != nil && len(field.Names) == 1 {
+					// The lengths are constant expressions like 3 * 3, rather than plain literals.
+					if tv, err := types.Eval(token.NewFileSet(), nil, token.NoPos, types.ExprString(at.Len)); err == nil && tv.Value != nil {
+						if n, ok := constant.Int64Val(tv.Value); ok {
+							sizes[field.Names[0].Name] = n
+						}
+					}
+				}
+			}
+			if 3*sizes["Count"] != sizes["Pos"] || sizes["Count"] != sizes["NumStmt"] {
+				return fmt.Errorf("%s has mismatched coverage data for %s: %d counters, %d positions and %d statement counts. Has it been instrumented more than once?",
+					filename, coverVar, sizes["Count"], sizes["Pos"], sizes["NumStmt"])
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// usesPackage returns true if the test main will refer to anything in the package under test,
+// or in its external test package if external is true.
+func (descr *testDescr) usesPackage(external bool) bool {
+	functions := append(append(append([]function{descr.Main, descr.Setup, descr.Teardown}, descr.Functions...), descr.Benchmarks...), descr.Fuzz...)
+	for _, ex := range descr.Examples {
+		functions = append(functions, function{Name: ex.Name, External: ex.External})
+	}
+	for _, test := range descr.AllocTests {
+		functions = append(functions, function{Name: test.Name, External: test.External})
+	}
+	for _, fn := range functions {
+		if fn.Name != "" && fn.External == external {
+			return true
+		}
+	}
+	return false
+}
+
+// Qualify returns the given function name qualified by the package it's defined in.
+func (descr testDescr) Qualify(name string, external bool) string {
+	if external {
+		return descr.XPackage + "." + name
+	}
+	return descr.Package + "." + name
+}
+
+// findSetupAndTeardown identifies any setup or teardown functions in the given test description.
+// If both test packages define one, the one in the package under test is used.
+func findSetupAndTeardown(descr *testDescr, setup, teardown string) error {
+	for _, name := range []string{setup, teardown} {
+		fn := function{Name: name}
+		if !descr.plainFunctions[fn] {
+			fn.External = true
+		}
+		if name == "" || !descr.plainFunctions[fn] {
+			continue
+		} else if descr.Main.Name != "" {
+			return fmt.Errorf("Can't have both %s and %s; call it from %s instead", descr.Main.Name, name, descr.Main.Name)
+		}
+		if name == setup {
+			descr.Setup = fn
+		} else {
+			descr.Teardown = fn
+		}
+	}
+	return nil
+}
+
+// checkSourceDirs checks that all the given sources are in the same directory.
+// The generated main can only import a single package under test so anything else is a misconfiguration.
+func checkSourceDirs(sources []string) error {
+	dirs := []string{}
+	seen := map[string]bool{}
 	for _, source := range sources {
-		f, err := parser.ParseFile(token.NewFileSet(), source, nil, 0)
+		if dir := filepath.Dir(source); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) > 1 {
+		return fmt.Errorf("Test sources must all be in the same directory, but they span %s", strings.Join(dirs, ", "))
+	}
+	return nil
+}
+
+// parseTestSources parses the test sources and returns the package and set of test functions in them.
+// The functions are in a stable order; see describeTestSources.
+func parseTestSources(sources []string, opts TestMainOptions) (testDescr, error) {
+	files, err := parseFiles(sources)
+	if err != nil {
+		return testDescr{Files: map[function]string{}}, err
+	}
+	return describeTestSources(files, DefaultPlatform(), opts)
+}
+
+// A parsedFile is a source file that has been parsed.
+type parsedFile struct {
+	Source string
+	File   *ast.File
+}
+
+// parseFiles parses all the given source files concurrently. The results are in the same order as the sources.
+// If any of them fail to parse, the returned error describes all the failures.
+func parseFiles(sources []string) ([]parsedFile, error) {
+	fset := token.NewFileSet()
+	files := make([]parsedFile, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			f, err := parser.ParseFile(fset, source, nil, parser.ParseComments)
+			files[i] = parsedFile{Source: source, File: f}
+			errs[i] = err
+		}(i, source)
+	}
+	wg.Wait()
+	msgs := []string{}
+	for i, err := range errs {
 		if err != nil {
-			log.Errorf("Error parsing %s: %s", source, err)
-			return descr, err
+			log.Errorf("Error parsing %s: %s", sources[i], err)
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return nil, fmt.Errorf("Failed to parse %d of %d test sources:\n%s", len(msgs), len(sources), strings.Join(msgs, "\n"))
+	}
+	return files, nil
+}
+
+// describeTestSources returns the package and set of test functions in the given files,
+// skipping any that wouldn't be built for the given platform with the toolchain described by opts.
+// Like go test, functions are ordered by the name of the file they're in, then by their order in that file,
+// so the result doesn't depend on the order the files are given in.
+func describeTestSources(files []parsedFile, platform Platform, opts TestMainOptions) (testDescr, error) {
+	files = append([]parsedFile{}, files...)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Source < files[j].Source })
+	descr := testDescr{Files: map[function]string{}, plainFunctions: map[function]bool{}}
+	tags := platform.tags(opts)
+	mainSource := ""
+	for _, file := range files {
+		source, f := file.Source, file.File
+		if !platform.matchesFileName(source) || isIgnored(f, tags) {
+			log.Info("Skipping %s, its build constraints aren't satisfied", source)
+			continue
 		}
-		descr.Package = f.Name.Name
-		// If we're testing main, we will get errors from it clashing with func main.
-		if descr.Package == "main" {
-			descr.Package = "_main"
+		external := strings.HasSuffix(f.Name.Name, "_test")
+		if external {
+			descr.XPackage = f.Name.Name
+		} else {
+			descr.Package = f.Name.Name
 		}
 		for _, d := range f.Decls {
 			if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv == nil {
 				name := fd.Name.String()
-				if isTestMain(fd) {
-					descr.Main = name
+				fn := function{Name: name, External: external}
+				plain := fd.Type.Params.NumFields() == 0 && fd.Type.Results.NumFields() == 0
+				if plain {
+					descr.plainFunctions[fn] = true
+				}
+				if plain && isTest(name, "AllocTest") {
+					descr.AllocTests = append(descr.AllocTests, allocTest{Name: name, External: external, Budget: allocBudget(fd)})
+				} else if isTestMain(fd) {
+					if mainSource != "" {
+						return descr, fmt.Errorf("TestMain is defined in both %s and %s, there can only be one", mainSource, source)
+					}
+					descr.Main = fn
+					mainSource = source
+				} else if isBenchmark(fd) {
+					descr.Benchmarks = append(descr.Benchmarks, fn)
+				} else if isFuzzTarget(fd) {
+					descr.Fuzz = append(descr.Fuzz, fn)
+				} else if isTest(name, "Test") && !takesPointerTo(fd, "T") {
+					// Plain functions can be setup or teardown functions, which are found later.
+					if !plain {
+						log.Warning("Skipping %s in %s, it has the wrong signature for a test; it should be func %s(t *testing.T)", name, source, name)
+					}
 				} else if isTest(name, "Test") {
-					descr.Functions = append(descr.Functions, name)
+					descr.Functions = append(descr.Functions, fn)
+					descr.Files[fn] = source
 				}
 			}
 		}
+		for _, ex := range doc.Examples(f) {
+			// Examples without an output comment are compiled but not run.
+			if ex.Output != "" || ex.EmptyOutput {
+				descr.Examples = append(descr.Examples, example{Name: "Example" + ex.Name, External: external, Output: ex.Output, Unordered: ex.Unordered})
+			}
+		}
+	}
+	if descr.Package == "" {
+		// There are only external tests, but we still need to know the package they're testing.
+		descr.Package = strings.TrimSuffix(descr.XPackage, "_test")
+	}
+	// If we're testing main, we will get errors from it clashing with func main.
+	if descr.Package == "main" {
+		descr.Package = "_main"
 	}
 	return descr, nil
 }
 
+// allocBudget returns the allocation budget from a function's //plz:allocs comment, or the empty string if there isn't one.
+func allocBudget(fd *ast.FuncDecl) string {
+	if fd.Doc != nil {
+		for _, comment := range fd.Doc.List {
+			if strings.HasPrefix(comment.Text, "//plz:allocs ") {
+				return strings.TrimSpace(strings.TrimPrefix(comment.Text, "//plz:allocs "))
+			}
+		}
+	}
+	return ""
+}
+
+// CgoEnabled is whether cgo is enabled for the target, which decides whether files
+// constrained on the "cgo" build tag are included.
+var CgoEnabled = os.Getenv("CGO_ENABLED") != "0"
+
+// isIgnored returns true if the given file has build constraints that can't be satisfied with the given tags.
+// That includes an "ignore" constraint, which by convention is never part of a build.
+func isIgnored(f *ast.File, tags map[string]bool) bool {
+	for _, group := range f.Comments {
+		if group.Pos() > f.Package {
+			break // Build constraints have to come before the package clause.
+		}
+		for _, comment := range group.List {
+			if constraint.IsGoBuild(comment.Text) || constraint.IsPlusBuild(comment.Text) {
+				if expr, err := constraint.Parse(comment.Text); err == nil && !canEvaluateTo(expr, true, tags) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// canEvaluateTo returns true if the given build constraint could evaluate to want,
+// given the values of the known tags. Other tags are unset, except for operating systems
+// and architectures that the platform doesn't specify, which can take either value.
+func canEvaluateTo(expr constraint.Expr, want bool, tags map[string]bool) bool {
+	switch e := expr.(type) {
+	case *constraint.TagExpr:
+		if value, present := tags[e.Tag]; present {
+			return value == want
+		}
+		return knownOS[e.Tag] || knownArch[e.Tag] || e.Tag == "unix" || !want
+	case *constraint.NotExpr:
+		return canEvaluateTo(e.X, !want, tags)
+	case *constraint.AndExpr:
+		if want {
+			return canEvaluateTo(e.X, true, tags) && canEvaluateTo(e.Y, true, tags)
+		}
+		return canEvaluateTo(e.X, false, tags) || canEvaluateTo(e.Y, false, tags)
+	case *constraint.OrExpr:
+		if want {
+			return canEvaluateTo(e.X, true, tags) || canEvaluateTo(e.Y, true, tags)
+		}
+		return canEvaluateTo(e.X, false, tags) && canEvaluateTo(e.Y, false, tags)
+	}
+	return true
+}
+
 // isTestMain returns true if fn is a TestMain(m *testing.M) function.
 // Copied from Go sources.
 func isTestMain(fn *ast.FuncDecl) bool {
-	if fn.Name.String() != "TestMain" ||
-		fn.Type.Results != nil && len(fn.Type.Results.List) > 0 ||
+	return fn.Name.String() == "TestMain" && takesPointerTo(fn, "M")
+}
+
+// isBenchmark returns true if fn is a BenchmarkXxx(b *testing.B) function.
+func isBenchmark(fn *ast.FuncDecl) bool {
+	return isTest(fn.Name.String(), "Benchmark") && takesPointerTo(fn, "B")
+}
+
+// isFuzzTarget returns true if fn is a FuzzXxx(f *testing.F) function.
+func isFuzzTarget(fn *ast.FuncDecl) bool {
+	return isTest(fn.Name.String(), "Fuzz") && takesPointerTo(fn, "F")
+}
+
+// takesPointerTo returns true if fn takes a single pointer to the given type from the testing package and returns nothing.
+func takesPointerTo(fn *ast.FuncDecl, typeName string) bool {
+	if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 ||
 		fn.Type.Params == nil ||
 		len(fn.Type.Params.List) != 1 ||
 		len(fn.Type.Params.List[0].Names) > 1 {
@@ -128,10 +957,10 @@ func isTestMain(fn *ast.FuncDecl) bool {
 	// We can't easily check that the type is *testing.M
 	// because we don't know how testing has been imported,
 	// but at least check that it's *M or *something.M.
-	if name, ok := ptr.X.(*ast.Ident); ok && name.Name == "M" {
+	if name, ok := ptr.X.(*ast.Ident); ok && name.Name == typeName {
 		return true
 	}
-	if sel, ok := ptr.X.(*ast.SelectorExpr); ok && sel.Sel.Name == "M" {
+	if sel, ok := ptr.X.(*ast.SelectorExpr); ok && sel.Sel.Name == typeName {
 		return true
 	}
 	return false
@@ -153,14 +982,43 @@ func isTest(name, prefix string) bool {
 // testMainTmpl is the template for our test main, copied from Go's builtin one.
 // Some bits are excluded because we don't support them and/or do them differently.
 var testMainTmpl = template.Must(template.New("main").Parse(`
-package main
+package {{if .LibraryPackage}}{{.LibraryPackage}}{{else}}main{{end}}
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+{{if or .StructuredLogs .CoverVars .JSONOutput .Retries}}
+	"strings"
+{{end}}
+{{if or .StructuredLogs .JSONOutput}}
+	"bufio"
+	"io"
+{{end}}
+{{if or .StructuredLogs .JSONOutput}}
+	"os/exec"
+{{end}}
+{{if or .StructuredLogs .LeakCheck .JSONOutput (and (not .TinyGo) (not .CoverOnly))}}
+	"time"
+{{end}}
+	"strconv"
 	"os"
 	"testing"
-{{if .Version18}}
+{{if .GoVersion.AtLeast 8}}
         "testing/internal/testdeps"
 {{end}}
+{{if and .Main.Name .ExitAfterTestMain}}
+	"reflect"
+{{end}}
+{{if or .GoMaxProcs .LeakCheck .MemStats}}
+	"runtime"
+{{end}}
+{{if or .MemStats .Retries}}
+	"sync"
+{{end}}
+{{if .Retries}}
+	"io/ioutil"
+{{end}}
 
 {{range .Imports}}
 	{{.}}
@@ -169,10 +1027,290 @@ import (
 
 var tests = []testing.InternalTest{
 {{range .Functions}}
-	{"{{.}}", {{$.Package}}.{{.}}},
+	{"{{.Name}}", {{if $.WrapTests}}wrapTest("{{.Name}}", {{$.Qualify .Name .External}}){{else}}{{$.Qualify .Name .External}}{{end}}},
+{{end}}
+{{range .AllocTests}}
+	{"{{.Name}}", {{if $.WrapTests}}wrapTest("{{.Name}}", checkAllocs({{$.Qualify .Name .External}}, {{.Budget}})){{else}}checkAllocs({{$.Qualify .Name .External}}, {{.Budget}}){{end}}},
+{{end}}
+}
+
+{{if .AllocTests}}
+// checkAllocs returns a test that fails if f makes more than budget allocations per run on average.
+func checkAllocs(f func(), budget float64) func(*testing.T) {
+	return func(t *testing.T) {
+		if allocs := testing.AllocsPerRun(100, f); allocs > budget {
+			t.Errorf("Made %v allocations per run, over the budget of %v", allocs, budget)
+		}
+	}
+}
+{{end}}
+
+{{if .WrapTests}}
+// wrapTest wraps a test function to do extra work around each run of it.
+func wrapTest(name string, test func(*testing.T)) func(*testing.T) {
+	return func(t *testing.T) {
+{{if .MemStats}}
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		defer recordMemStats(name, &before)
+{{end}}
+{{if .Retries}}
+		if testRetries > 0 {
+			runWithRetries(t, name, test)
+			return
+		}
+{{end}}
+		test(t)
+	}
+}
+{{end}}
+
+{{if .Retries}}
+// testRetries is how many more times a failed test is run, from $TEST_RETRIES.
+var testRetries int
+
+// retryMutex stops retried tests that run in parallel from capturing each other's output.
+// That means they don't really run in parallel any more.
+var retryMutex sync.Mutex
+
+// runWithRetries runs a test until it passes, up to testRetries more times after the first attempt.
+// Each attempt runs as a separate top-level test with its output captured, so the ones that fail
+// don't fail t and aren't reported as failures; only the last attempt's output is kept.
+// Since each attempt goes through testing.RunTests, it honours -test.count and -test.cpu itself,
+// so the test runs that many more times again.
+func runWithRetries(t *testing.T, name string, test func(*testing.T)) {
+	attempts := testRetries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		passed, output, err := runAttempt(name, test)
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", name, err)
+		}
+		if passed || attempt == attempts {
+			os.Stdout.WriteString(output)
+		}
+		if passed {
+			if attempt > 1 {
+				t.Logf("%s passed on attempt %d of %d", name, attempt, attempts)
+			}
+			return
+		}
+	}
+	t.Errorf("%s failed all %d attempts", name, attempts)
+}
+
+// runAttempt runs a test once, returning whether it passed and what it wrote to stdout.
+// The lines reporting on the test itself are dropped since the caller is already reported as it.
+func runAttempt(name string, test func(*testing.T)) (bool, string, error) {
+	retryMutex.Lock()
+	defer retryMutex.Unlock()
+	f, err := ioutil.TempFile("", "test_attempt")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	attempt := func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != nil {
+				// The panic is about to take the whole binary down, so don't lose what the test wrote.
+				os.Stdout = stdout
+				if b, err := ioutil.ReadFile(f.Name()); err == nil {
+					stdout.Write(b)
+				}
+				panic(r)
+			}
+		}()
+		test(t)
+	}
+{{if .GoVersion.AtLeast 8}}
+	passed := testing.RunTests(testDeps.MatchString, []testing.InternalTest{{"{{"}}name, attempt{{"}}"}})
+{{else}}
+	passed := testing.RunTests(testDeps, []testing.InternalTest{{"{{"}}name, attempt{{"}}"}})
+{{end}}
+	os.Stdout = stdout
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return false, "", err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	output := lines[:0]
+	for _, line := range lines {
+		if fields := testMarker(line); len(fields) >= 3 && fields[2] == name {
+			continue
+		}
+		output = append(output, line)
+	}
+	return passed, strings.Join(output, ""), nil
+}
+{{end}}
+
+{{if .MemStats}}
+// testMemStats describes the heap allocations made while a test ran.
+// Tests running in parallel will see each other's allocations.
+type testMemStats struct {
+	Test       string
+	TotalAlloc uint64 // Bytes allocated
+	Mallocs    uint64 // Number of allocations
+	HeapAlloc  int64  // Change in bytes of live heap objects
+}
+
+var memStats = []testMemStats{}
+var memStatsMutex sync.Mutex
+
+// recordMemStats records the allocations made by a test since the given stats were read.
+func recordMemStats(name string, before *runtime.MemStats) {
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	memStatsMutex.Lock()
+	defer memStatsMutex.Unlock()
+	memStats = append(memStats, testMemStats{
+		Test:       name,
+		TotalAlloc: after.TotalAlloc - before.TotalAlloc,
+		Mallocs:    after.Mallocs - before.Mallocs,
+		HeapAlloc:  int64(after.HeapAlloc) - int64(before.HeapAlloc),
+	})
+}
+
+// writeMemStats writes the recorded stats as JSON to $TEST_MEMSTATS_FILE, or to stderr if it's not set.
+func writeMemStats() {
+	w := os.Stderr
+	if filename := os.Getenv("TEST_MEMSTATS_FILE"); filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write memory stats: %s\n", err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(memStats); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write memory stats: %s\n", err)
+	}
+}
+{{end}}
+
+var benchmarks = []testing.InternalBenchmark{
+{{range .Benchmarks}}
+	{"{{.Name}}", {{$.Qualify .Name .External}}},
 {{end}}
 }
 
+{{if or (.GoVersion.AtLeast 18) .TinyGo}}
+var fuzzTargets = []testing.InternalFuzzTarget{
+{{range .Fuzz}}
+	{"{{.Name}}", {{$.Qualify .Name .External}}},
+{{end}}
+}
+{{end}}
+
+var examples = []testing.InternalExample{
+{{range .Examples}}
+	{"{{.Name}}", {{$.Qualify .Name .External}}, {{printf "%q" .Output}}, {{.Unordered}}},
+{{end}}
+}
+
+// printTestPlan prints the tests and examples that match the given filter as JSON.
+// Benchmarks are only run if there's a benchmark filter, so they're only printed if they match it.
+func printTestPlan(filter, benchFilter string) error {
+	plan := map[string][]string{"tests": {}, "benchmarks": {}, "examples": {}}
+	re, err := regexp.Compile(filter)
+	if err != nil {
+		return fmt.Errorf("Invalid test filter %s: %s", filter, err)
+	}
+	for _, test := range tests {
+		if re.MatchString(test.Name) {
+			plan["tests"] = append(plan["tests"], test.Name)
+		}
+	}
+	if benchFilter != "" {
+		benchRe, err := regexp.Compile(benchFilter)
+		if err != nil {
+			return fmt.Errorf("Invalid benchmark filter %s: %s", benchFilter, err)
+		}
+		for _, benchmark := range benchmarks {
+			if benchRe.MatchString(benchmark.Name) {
+				plan["benchmarks"] = append(plan["benchmarks"], benchmark.Name)
+			}
+		}
+	}
+	for _, example := range examples {
+		if re.MatchString(example.Name) {
+			plan["examples"] = append(plan["examples"], example.Name)
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(plan); err != nil {
+		return fmt.Errorf("Failed to write test plan: %s", err)
+	}
+	return nil
+}
+
+// shardTests returns the tests in this shard if $TEST_SHARD_COUNT is set, or all of them if not.
+// Tests are assigned to shards by a hash of their name so each one is always in the same shard.
+func shardTests(tests []testing.InternalTest) ([]testing.InternalTest, error) {
+	count := os.Getenv("TEST_SHARD_COUNT")
+	if count == "" {
+		return tests, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("Invalid $TEST_SHARD_COUNT %s, should be a positive integer", count)
+	}
+	index, err := strconv.Atoi(os.Getenv("TEST_SHARD_INDEX"))
+	if err != nil || index < 0 || index >= n {
+		return nil, fmt.Errorf("Invalid $TEST_SHARD_INDEX %q, should be between 0 and %d", os.Getenv("TEST_SHARD_INDEX"), n-1)
+	}
+	shard := []testing.InternalTest{}
+	for _, test := range tests {
+		// This is FNV-1a, which is short enough to write out rather than importing hash/fnv.
+		h := uint32(2166136261)
+		for i := 0; i < len(test.Name); i++ {
+			h ^= uint32(test.Name[i])
+			h *= 16777619
+		}
+		if int(h%uint32(n)) == index {
+			shard = append(shard, test)
+		}
+	}
+	return shard, nil
+}
+
+// envBool returns true if the given environment variable is set to anything other than a false-like value.
+func envBool(name string) bool {
+	switch os.Getenv(name) {
+	case "", "0", "false", "False", "FALSE", "no", "off":
+		return false
+	}
+	return true
+}
+
+{{if not .TinyGo}}
+// countPositiveInts returns how many integers there are in s, which should be a comma-separated list
+// of positive integers. It returns zero if s isn't in that form.
+func countPositiveInts(s string) int {
+	n := 0
+	positive := false
+	for _, c := range s + "," {
+		if c == ',' {
+			if !positive {
+				return 0
+			}
+			positive = false
+			n++
+		} else if c < '0' || c > '9' {
+			return 0
+		} else if c != '0' {
+			positive = true
+		}
+	}
+	return n
+}
+{{end}}
+
 {{if .CoverVars}}
 
 // Only updated by init functions, so no need for atomicity.
@@ -189,13 +1327,17 @@ func init() {
 
 func coverRegisterFile(fileName string, counter []uint32, pos []uint32, numStmts []uint16) {
 	if 3*len(counter) != len(pos) || len(counter) != len(numStmts) {
-		panic("coverage: mismatched sizes")
+		panic(fmt.Sprintf("coverage: mismatched sizes for %s: %d counters, %d positions and %d statement counts", fileName, len(counter), len(pos), len(numStmts)))
 	}
 	if coverCounters[fileName] != nil {
 		// Already registered.
 		return
 	}
+	// This shares the instrumented package's counters rather than copying them, so every update is seen.
+	// In atomic mode the testing package reads them with sync/atomic.
 	coverCounters[fileName] = counter
+	// Each block is three values; its start and end lines, then both columns packed into one
+	// with the start in the low 16 bits and the end in the high 16, as go tool cover writes them.
 	block := make([]testing.CoverBlock, len(counter))
 	for i := range counter {
 		block[i] = testing.CoverBlock{
@@ -208,41 +1350,506 @@ func coverRegisterFile(fileName string, counter []uint32, pos []uint32, numStmts
 	}
 	coverBlocks[fileName] = block
 }
+
+// selectCoverageFile picks the file to write coverage to from a comma-separated list,
+// using $TEST_SHARD_INDEX so that shards of the same test don't overwrite each other's profile.
+func selectCoverageFile(files string) (string, error) {
+	paths := strings.Split(files, ",")
+	for i, p := range paths {
+		if paths[i] = strings.TrimSpace(p); paths[i] == "" {
+			return "", fmt.Errorf("Invalid $COVERAGE_FILES: %q contains an empty entry", files)
+		}
+	}
+	index := 0
+	if shard := os.Getenv("TEST_SHARD_INDEX"); shard != "" {
+		i, err := strconv.Atoi(shard)
+		if err != nil || i < 0 || i >= len(paths) {
+			return "", fmt.Errorf("$TEST_SHARD_INDEX %s doesn't match the %d files in $COVERAGE_FILES", shard, len(paths))
+		}
+		index = i
+	}
+	return paths[index], nil
+}
+{{end}}
+
+{{if .LeakCheck}}
+// checkGoroutineLeaks waits for the number of goroutines to drop back to what it was before the
+// tests ran. If it doesn't within the grace period it prints all their stacks and returns false.
+func checkGoroutineLeaks(before int) bool {
+	deadline := time.Now().Add(time.Duration({{.LeakGracePeriod.Nanoseconds}}))
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			fmt.Fprintf(os.Stderr, "%d goroutines leaked by tests:\n%s\n", runtime.NumGoroutine()-before, buf)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
 {{end}}
 
-{{if .Version18}}
+{{if or .StructuredLogs .JSONOutput .Retries}}
+// testMarker returns the fields of a line that -test.v writes as a test starts, switches or finishes,
+// e.g. "=== RUN   TestFoo" or "--- PASS: TestFoo (0.01s)", or nil if it isn't one.
+// The test's name is the third field; === lines can leave it out for output that isn't from a test.
+func testMarker(line string) []string {
+	fields := strings.Fields(line)
+	if (len(fields) >= 2 && fields[0] == "===") || (len(fields) >= 3 && fields[0] == "---") {
+		return fields
+	}
+	return nil
+}
+{{end}}
+
+{{if or .StructuredLogs .JSONOutput}}
+// testTracker follows which test is writing output from the markers in it.
+type testTracker struct {
+	current string
+}
+
+// track updates the current test from a line of output, returning its marker fields if it is one.
+func (tr *testTracker) track(line string) []string {
+	fields := testMarker(line)
+	if fields == nil {
+		return nil
+	}
+	tr.current = ""
+	if fields[0] == "===" {
+		if len(fields) >= 3 {
+			tr.current = fields[2]
+		}
+	} else if idx := strings.LastIndexByte(fields[2], '/'); idx != -1 {
+		// Any further output belongs to the parent test, if there is one.
+		tr.current = fields[2][:idx]
+	}
+	return fields
+}
+{{end}}
+
+{{if .StructuredLogs}}
+// runWithStructuredLogs runs this binary again with the same arguments, copying its output through
+// structuredLogs, which writes the structured version to $TEST_STRUCTURED_LOGS, or to stderr if that
+// isn't set. Stdout itself is left as it is. It returns the exit code of the run.
+// Running separately means we see all the output even if the tests call os.Exit or panic.
+func runWithStructuredLogs() int {
+	logs := os.Stderr
+	if filename := os.Getenv("TEST_STRUCTURED_LOGS"); filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create structured log file: %s\n", err)
+			return 1
+		}
+		defer f.Close()
+		logs = f
+	}
+	r, w := io.Pipe()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "TEST_STRUCTURED_LOGS_CHILD=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	done := make(chan struct{})
+	go func() {
+		structuredLogs(r, os.Stdout, logs)
+		close(done)
+	}()
+	err := cmd.Run()
+	w.Close()
+	<-done
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run tests: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// structuredLogs copies each line of output to w unchanged, and to logs prefixed with a timestamp
+// and the name of the test it came from. The current test is tracked from the markers that -test.v
+// writes as tests start, switch and finish.
+func structuredLogs(r io.Reader, w, logs io.Writer) {
+	var tracker testTracker
+	finished := "" // Older versions of Go write a test's logs indented after it finishes.
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			io.WriteString(w, line)
+			test := tracker.current
+			if fields := tracker.track(line); fields == nil {
+				if finished != "" && strings.TrimLeft(line, " \t") != line {
+					test = finished
+				} else {
+					finished = ""
+				}
+			} else if fields[0] == "===" {
+				test = tracker.current
+				finished = ""
+			} else {
+				test = fields[2]
+				finished = test
+			}
+			fmt.Fprintf(logs, "%s [%s] %s\n", time.Now().Format(time.RFC3339Nano), test, strings.TrimSuffix(line, "\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+{{end}}
+
+{{if .JSONOutput}}
+// runAsJSON runs this binary again with the same arguments and converts its output to JSON events,
+// in the same format as go test -json. It returns the exit code of the run.
+// Running separately means we see all the output even if the tests call os.Exit or panic.
+func runAsJSON() int {
+	start := time.Now()
+	r, w := io.Pipe()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "TEST_OUTPUT=")
+	cmd.Stdout = w
+	cmd.Stderr = w
+	enc := json.NewEncoder(os.Stdout)
+	done := make(chan struct{})
+	go func() {
+		jsonEvents(r, enc)
+		close(done)
+	}()
+	err := cmd.Run()
+	w.Close()
+	<-done
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run tests: %s\n", err)
+		code = 1
+	}
+	if code == 0 {
+		emitEvent(enc, "pass", "", "", time.Since(start).Seconds())
+	} else {
+		emitEvent(enc, "fail", "", "", time.Since(start).Seconds())
+	}
+	return code
+}
+
+// jsonEvents converts each line of -test.v output into JSON events.
+// The current test is tracked from the markers that -test.v writes as tests start, switch and finish.
+func jsonEvents(r io.Reader, enc *json.Encoder) {
+	var tracker testTracker
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			fields := tracker.track(line)
+			current := tracker.current
+			if fields == nil {
+				emitEvent(enc, "output", current, line, 0)
+			} else if fields[0] == "===" {
+				switch fields[1] {
+				case "RUN":
+					emitEvent(enc, "run", current, "", 0)
+				case "PAUSE":
+					emitEvent(enc, "pause", current, "", 0)
+				case "CONT":
+					emitEvent(enc, "cont", current, "", 0)
+				}
+				emitEvent(enc, "output", current, line, 0)
+			} else {
+				test := fields[2]
+				emitEvent(enc, "output", test, line, 0)
+				var elapsed float64
+				if len(fields) >= 4 {
+					fmt.Sscanf(fields[3], "(%fs)", &elapsed)
+				}
+				emitEvent(enc, strings.ToLower(strings.TrimSuffix(fields[1], ":")), test, "", elapsed)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// emitEvent writes a single JSON event. Fields that aren't relevant to it are omitted.
+func emitEvent(enc *json.Encoder, action, test, output string, elapsed float64) {
+	event := map[string]interface{}{
+		"Time":    time.Now(),
+		"Action":  action,
+		"Package": {{printf "%q" .PackagePath}},
+	}
+	if test != "" {
+		event["Test"] = test
+	}
+	if output != "" {
+		event["Output"] = output
+	}
+	if action == "pass" || action == "fail" || action == "skip" {
+		event["Elapsed"] = elapsed
+	}
+	enc.Encode(event)
+}
+{{end}}
+
+{{if .GoVersion.AtLeast 8}}
 var testDeps = testdeps.TestDeps{}
+{{else if .TinyGo}}
+// TinyGo's MainStart only needs something that can match test names.
+type tinyGoDeps struct{}
+
+func (tinyGoDeps) MatchString(pat, str string) (bool, error) {
+    return regexp.MatchString(pat, str)
+}
+
+var testDeps = tinyGoDeps{}
 {{else}}
-func testDeps(pat, str string) (bool, error) {
-    return pat == str, nil
+// This matches test names the same way as testing/internal/testdeps in later versions.
+// The testing package splits patterns for subtests on slashes itself, so it only sees one element at a time.
+var matchPat string
+var matchRe *regexp.Regexp
+
+func testDeps(pat, str string) (result bool, err error) {
+    if matchRe == nil || matchPat != pat {
+        matchPat = pat
+        matchRe, err = regexp.Compile(matchPat)
+        if err != nil {
+            return
+        }
+    }
+    return matchRe.MatchString(str), nil
 }
 {{end}}
 
+{{if .LibraryPackage}}
+// RunTests runs the tests as the main would, returning the exit code instead of exiting.
+func RunTests() int {
+{{else}}
 func main() {
+{{end}}
+{{if .JSONOutput}}
+	if os.Getenv("TEST_OUTPUT") == "json" {
+		os.Exit(runAsJSON())
+	}
+{{end}}
+{{if .StructuredLogs}}
+	if os.Getenv("TEST_STRUCTURED_LOGS_CHILD") == "" {
+		os.Exit(runWithStructuredLogs())
+	}
+{{end}}
 {{if .CoverVars}}
 	testing.RegisterCover(testing.Cover{
-		Mode: "set",
+		Mode: "{{.CoverMode}}",
 		Counters: coverCounters,
 		Blocks: coverBlocks,
-		CoveredPackages: "",
+		CoveredPackages: {{printf "%q" .CoveredPackages}},
 	})
-    coverfile := os.Getenv("COVERAGE_FILE")
-    args := []string{os.Args[0], "-test.v", "-test.coverprofile", coverfile}
+{{end}}
+{{if .CoverOnly}}
+	fmt.Printf("Registered coverage for %d files\n", len(coverCounters))
+	{{.Exit}}(0)
 {{else}}
     args := []string{os.Args[0], "-test.v"}
+{{if .GoVersion.AtLeast 20}}
+    coverdir := os.Getenv("GOCOVERDIR")
+    if coverdir != "" {
+        args = append(args, "-test.gocoverdir", coverdir)
+    }
+{{end}}
+{{if .CoverVars}}
+    coverfile := os.Getenv("COVERAGE_FILE")
+    if coverfiles := os.Getenv("COVERAGE_FILES"); coverfile == "" && coverfiles != "" {
+        var err error
+        if coverfile, err = selectCoverageFile(coverfiles); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            {{.Exit}}(1)
+        }
+    }
+    if coverfile == "" {{if .GoVersion.AtLeast 20}}&& coverdir == "" {{end}}{
+        fmt.Fprintln(os.Stderr, "This test was built with coverage but neither $COVERAGE_FILE nor $COVERAGE_FILES is set")
+        {{.Exit}}(1)
+    } else if coverfile != "" {
+        args = append(args, "-test.coverprofile", coverfile)
+    }
 {{end}}
     testVar := os.Getenv("TESTS")
     if testVar != "" {
         args = append(args, "-test.run", testVar)
     }
+    if skipVar := os.Getenv("TEST_SKIP"); skipVar != "" {
+{{if .GoVersion.AtLeast 20}}
+        // As with go test, anything matching this is skipped even if it also matches $TESTS.
+        args = append(args, "-test.skip", skipVar)
+{{else}}
+        fmt.Fprintln(os.Stderr, "Warning: $TEST_SKIP needs Go 1.20 or later, ignoring it")
+{{end}}
+    }
+    if listVar := os.Getenv("TEST_LIST"); listVar != "" {
+{{if .GoVersion.AtLeast 9}}
+        // This prints the names of matching tests, benchmarks and examples, then exits without running them.
+        args = append(args, "-test.list", listVar)
+{{else}}
+        fmt.Fprintln(os.Stderr, "Warning: $TEST_LIST needs Go 1.9 or later, ignoring it")
+{{end}}
+    }
+    if envBool("TEST_SHORT") {
+        args = append(args, "-test.short")
+    }
+    if envBool("TEST_FAILFAST") {
+{{if .GoVersion.AtLeast 10}}
+        args = append(args, "-test.failfast")
+{{else}}
+        fmt.Fprintln(os.Stderr, "Warning: $TEST_FAILFAST needs Go 1.10 or later, ignoring it")
+{{end}}
+    }
+    if shuffle := os.Getenv("TEST_SHUFFLE"); shuffle != "" {
+{{if .GoVersion.AtLeast 17}}
+        // This is on, off or an explicit seed; the testing package validates it and prints
+        // the seed it chose, so a failing order can be reproduced.
+        args = append(args, "-test.shuffle", shuffle)
+{{else}}
+        fmt.Fprintln(os.Stderr, "Warning: $TEST_SHUFFLE needs Go 1.17 or later, ignoring it")
+{{end}}
+    }
+{{if not .TinyGo}}
+    if timeout := os.Getenv("TEST_TIMEOUT"); timeout != "" {
+        // Like please's own flags, plain numbers are treated as seconds.
+        if _, err := time.ParseDuration(timeout); err != nil {
+            if _, err2 := time.ParseDuration(timeout + "s"); err2 != nil {
+                fmt.Fprintf(os.Stderr, "Invalid $TEST_TIMEOUT %s: %s\n", timeout, err)
+                {{.Exit}}(1)
+            }
+            timeout += "s"
+        }
+        args = append(args, "-test.timeout", timeout)
+    }
+    if parallelism := os.Getenv("TEST_PARALLELISM"); parallelism != "" {
+        if countPositiveInts(parallelism) != 1 {
+            fmt.Fprintf(os.Stderr, "Invalid $TEST_PARALLELISM %s, should be a positive integer\n", parallelism)
+            {{.Exit}}(1)
+        }
+        args = append(args, "-test.parallel", parallelism)
+    }
+    if cpu := os.Getenv("TEST_CPU"); cpu != "" {
+        if countPositiveInts(cpu) == 0 {
+            fmt.Fprintf(os.Stderr, "Invalid $TEST_CPU %s, should be a comma-separated list of positive integers\n", cpu)
+            {{.Exit}}(1)
+        }
+        args = append(args, "-test.cpu", cpu)
+    }
+    // Relative profile paths are put under $PROFILE_DIR if it's set.
+    profileDir := os.Getenv("PROFILE_DIR")
+    for _, profile := range []struct{ env, flag string }{
+        {"CPU_PROFILE", "-test.cpuprofile"},
+        {"MEM_PROFILE", "-test.memprofile"},
+        {"BLOCK_PROFILE", "-test.blockprofile"},
+{{if .GoVersion.AtLeast 8}}
+        {"MUTEX_PROFILE", "-test.mutexprofile"},
+{{end}}
+    } {
+        if filename := os.Getenv(profile.env); filename != "" {
+            if profileDir != "" && !os.IsPathSeparator(filename[0]) {
+                filename = profileDir + string(os.PathSeparator) + filename
+            }
+            args = append(args, profile.flag, filename)
+        }
+    }
+{{if not (.GoVersion.AtLeast 8)}}
+    if os.Getenv("MUTEX_PROFILE") != "" {
+        fmt.Fprintln(os.Stderr, "Warning: $MUTEX_PROFILE needs Go 1.8 or later, ignoring it")
+    }
+{{end}}
+{{end}}
+{{if .GoVersion.AtLeast 18}}
+    // Without this, fuzz targets are only run against their seed corpus.
+    if fuzzVar := os.Getenv("FUZZ"); fuzzVar != "" {
+        args = append(args, "-test.fuzz", fuzzVar)
+        // testing won't fuzz without somewhere to keep the inputs it generates. By default that's
+        // a fresh directory under $TMP_DIR, so it's cleaned up along with the rest of the test's files.
+        // It's exported so the worker processes the fuzzer starts share it rather than making their own.
+        corpus := os.Getenv("FUZZ_CORPUS_DIR")
+        if corpus == "" {
+            dir, err := os.MkdirTemp(os.Getenv("TMP_DIR"), "fuzz_cache")
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to create fuzz cache directory: %s\n", err)
+                {{.Exit}}(1)
+            }
+            corpus = dir
+            os.Setenv("FUZZ_CORPUS_DIR", corpus)
+        }
+        args = append(args, "-test.fuzzcachedir", corpus)
+    }
+{{end}}
+{{if .Retries}}
+    if retries := os.Getenv("TEST_RETRIES"); retries != "" {
+        n, err := strconv.Atoi(retries)
+        if err != nil || n < 0 {
+            fmt.Fprintf(os.Stderr, "Invalid $TEST_RETRIES %s, should be a non-negative integer\n", retries)
+            {{.Exit}}(1)
+        }
+        testRetries = n
+    }
+{{end}}
+    benchVar := os.Getenv("BENCHMARKS")
+    if benchVar != "" {
+        args = append(args, "-test.bench", benchVar)
+    }
     os.Args = append(args, os.Args[1:]...)
-	benchmarks := []testing.InternalBenchmark{}
-	var examples = []testing.InternalExample{}
+    shard, err := shardTests(tests)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        {{.Exit}}(1)
+    }
+    tests = shard
+    if os.Getenv("TEST_PLAN") != "" {
+        if err := printTestPlan(testVar, benchVar); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            {{.Exit}}(1)
+        }
+        {{.Exit}}(0)
+    }
+{{if .GoMaxProcs}}
+	runtime.GOMAXPROCS({{.GoMaxProcs}})
+{{end}}
+{{if or (.GoVersion.AtLeast 18) .TinyGo}}
+	m := testing.MainStart(testDeps, tests, benchmarks, fuzzTargets, examples)
+{{else}}
 	m := testing.MainStart(testDeps, tests, benchmarks, examples)
-{{if .Main}}
-	{{.Package}}.{{.Main}}(m)
+{{end}}
+{{if .Main.Name}}
+	{{.Qualify .Main.Name .Main.External}}(m)
+{{if .ExitAfterTestMain}}
+	// If we get here TestMain returned without calling os.Exit. Newer versions of Go
+	// record the result of m.Run() which we can use; otherwise we can't tell if the tests passed.
+	if code := reflect.ValueOf(m).Elem().FieldByName("exitCode"); code.IsValid() {
+		{{.Exit}}(int(code.Int()))
+	}
+	fmt.Fprintln(os.Stderr, "TestMain returned without calling os.Exit, can't determine test result")
+	{{.Exit}}(1)
+{{end}}
 {{else}}
-	os.Exit(m.Run())
+{{if .LeakCheck}}
+	goroutines := runtime.NumGoroutine()
+{{end}}
+{{if .Setup.Name}}
+	{{.Qualify .Setup.Name .Setup.External}}()
+{{end}}
+	code := m.Run()
+{{if .Teardown.Name}}
+	{{.Qualify .Teardown.Name .Teardown.External}}()
+{{end}}
+{{if .LeakCheck}}
+	if !checkGoroutineLeaks(goroutines) && code == 0 {
+		code = 1
+	}
+{{end}}
+{{if .MemStats}}
+	writeMemStats()
+{{end}}
+	{{.Exit}}(code)
+{{end}}
 {{end}}
 }
 `))
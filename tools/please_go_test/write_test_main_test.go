@@ -1,18 +1,28 @@
 package buildgo
 
 import (
+	"encoding/json"
+	"fmt"
+	"go/build"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestParseTestSources(t *testing.T) {
-	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/example_test.go"})
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/example_test.go"}, TestMainOptions{})
 	assert.NoError(t, err)
 	assert.Equal(t, "buildgo", descr.Package)
-	assert.Equal(t, "", descr.Main)
+	assert.Equal(t, "", descr.Main.Name)
 	functions := []string{
 		"TestReadPkgdef",
 		"TestReadCopiedPkgdef",
@@ -20,14 +30,14 @@ func TestParseTestSources(t *testing.T) {
 		"TestFindCoverVarsFailsGracefully",
 		"TestFindCoverVarsReturnsNothingForEmptyPath",
 	}
-	assert.Equal(t, functions, descr.Functions)
+	assert.Equal(t, functions, names(descr.Functions))
 }
 
 func TestParseTestSourcesWithMain(t *testing.T) {
-	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/example_test_main.go"})
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/example_test_main.go"}, TestMainOptions{})
 	assert.NoError(t, err)
 	assert.Equal(t, "parse", descr.Package)
-	assert.Equal(t, "TestMain", descr.Main)
+	assert.Equal(t, "TestMain", descr.Main.Name)
 	functions := []string{
 		"TestParseSourceBuildLabel",
 		"TestParseSourceRelativeBuildLabel",
@@ -37,21 +47,283 @@ func TestParseTestSourcesWithMain(t *testing.T) {
 		"TestParseSourceWithAbsolutePath",
 		"TestAddTarget",
 	}
-	assert.Equal(t, functions, descr.Functions)
+	assert.Equal(t, functions, names(descr.Functions))
+}
+
+func TestParseTestSourcesSkipsIgnoredFiles(t *testing.T) {
+	descr, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/example_test.go",
+		"tools/please_go_test/test_data/ignored_test.go",
+	}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "buildgo", descr.Package)
+	assert.NotContains(t, names(descr.Functions), "TestIgnored")
+	assert.Equal(t, 5, len(descr.Functions))
+}
+
+func TestParseTestSourcesCgoConstraints(t *testing.T) {
+	defer func(enabled bool) { CgoEnabled = enabled }(CgoEnabled)
+	srcs := []string{
+		"tools/please_go_test/test_data/cgo_test.go",
+		"tools/please_go_test/test_data/nocgo_test.go",
+	}
+	CgoEnabled = true
+	descr, err := parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestCgo"}, names(descr.Functions))
+	CgoEnabled = false
+	descr, err = parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestNoCgo"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesBuildTags(t *testing.T) {
+	defer func(tags []string) { BuildTags = tags }(BuildTags)
+	srcs := []string{"tools/please_go_test/test_data/tagged_test.go"}
+	descr, err := parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestNotIntegration"}, names(descr.Functions))
+	BuildTags = []string{"integration"}
+	descr, err = parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(descr.Functions))
+}
+
+func TestParseTestSourcesRequiredBuildTag(t *testing.T) {
+	defer func(tags []string) { BuildTags = tags }(BuildTags)
+	srcs := []string{
+		"tools/please_go_test/test_data/tagged_test.go",
+		"tools/please_go_test/test_data/integration_test.go",
+	}
+	// A tag that isn't given is unset, so the file that requires it isn't built.
+	descr, err := parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestNotIntegration"}, names(descr.Functions))
+	BuildTags = []string{"integration"}
+	descr, err = parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestIntegration"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesReleaseTags(t *testing.T) {
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/release_test.go"}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestGo11"}, names(descr.Functions))
+	// The release tags come from the version of the toolchain, not the Go we were built with.
+	srcs := []string{
+		"tools/please_go_test/test_data/release_go121_test.go",
+		"tools/please_go_test/test_data/release_pre_go121_test.go",
+	}
+	descr, err = parseTestSources(srcs, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 20}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestBeforeGo121"}, names(descr.Functions))
+	descr, err = parseTestSources(srcs, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 21}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestGo121"}, names(descr.Functions))
+	descr, err = parseTestSources(srcs, TestMainOptions{GoVersion: develVersion})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestGo121"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesCompilerTags(t *testing.T) {
+	srcs := []string{
+		"tools/please_go_test/test_data/release_test.go",
+		"tools/please_go_test/test_data/tinygo_test.go",
+	}
+	descr, err := parseTestSources(srcs, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestGo11"}, names(descr.Functions))
+	descr, err = parseTestSources(srcs, TestMainOptions{Target: "tinygo"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestTinyGo"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesDefaultPlatform(t *testing.T) {
+	descr, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/platform/platform_test.go",
+		"tools/please_go_test/test_data/platform/platform_linux_test.go",
+		"tools/please_go_test/test_data/platform/windows_test.go",
+	}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, names(descr.Functions), "TestAllPlatforms")
+	assert.Equal(t, build.Default.GOOS == "linux", contains("TestLinux", names(descr.Functions)))
+	assert.Equal(t, build.Default.GOOS == "windows", contains("TestWindows", names(descr.Functions)))
+}
+
+func TestParseTestSourcesExternal(t *testing.T) {
+	descr, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/external/internal_test.go",
+		"tools/please_go_test/test_data/external/external_test.go",
+	}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "external", descr.Package)
+	assert.Equal(t, "external_test", descr.XPackage)
+	assert.Equal(t, []function{{Name: "TestExternal", External: true}, {Name: "TestInternal"}}, descr.Functions)
+	assert.Equal(t, []example{{Name: "ExampleExternal", External: true, Output: "hello\n"}}, descr.Examples)
+	assert.Equal(t, "external.TestInternal", descr.Qualify("TestInternal", false))
+	assert.Equal(t, "external_test.TestExternal", descr.Qualify("TestExternal", true))
+}
+
+func TestWriteTestMainExternal(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data/external", []string{
+		"tools/please_go_test/test_data/external/internal_test.go",
+		"tools/please_go_test/test_data/external/external_test.go",
+	}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `external "tools/please_go_test/test_data/external"`)
+	assert.Contains(t, string(b), `external_test "tools/please_go_test/test_data/external_test"`)
+	assert.Contains(t, string(b), `{"TestInternal", external.TestInternal}`)
+	assert.Contains(t, string(b), `{"TestExternal", external_test.TestExternal}`)
+	assert.Contains(t, string(b), `external_test.ExampleExternal`)
+	// With only the external tests, the package under test is imported but not referred to.
+	err = WriteTestMain("tools/please_go_test/test_data/external", []string{
+		"tools/please_go_test/test_data/external/external_test.go",
+	}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `_ "tools/please_go_test/test_data/external"`)
+	assert.Contains(t, string(b), `{"TestExternal", external_test.TestExternal}`)
+}
+
+func TestParseTestSourcesSameNameInBothPackages(t *testing.T) {
+	descr, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/dup/external_test.go",
+		"tools/please_go_test/test_data/dup/internal_test.go",
+	}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []function{{Name: "TestSame", External: true}, {Name: "TestSame"}}, descr.Functions)
+	assert.Equal(t, "tools/please_go_test/test_data/dup/external_test.go", descr.Files[function{Name: "TestSame", External: true}])
+	assert.Equal(t, "tools/please_go_test/test_data/dup/internal_test.go", descr.Files[function{Name: "TestSame"}])
+}
+
+func TestWriteTestMainSameNameInBothPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	srcs := []string{
+		"tools/please_go_test/test_data/dup/external_test.go",
+		"tools/please_go_test/test_data/dup/internal_test.go",
+	}
+	binary := buildTestMain(t, dir, srcs, nil, TestMainOptions{SetupFunction: "TestMainSetup"})
+	out, code := runTestMain(t, binary)
+	assert.Equal(t, 0, code, out)
+	assert.Equal(t, 1, strings.Count(out, "internal TestSame"), out)
+	assert.Equal(t, 1, strings.Count(out, "external TestSame"), out)
+	// The setup function in the package under test takes precedence.
+	assert.Contains(t, out, "internal setup")
+	assert.NotContains(t, out, "external setup")
+}
+
+func TestParseTestSourcesMalformedSignatures(t *testing.T) {
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/malformed_test.go"}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestValid"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesExternalTestMain(t *testing.T) {
+	descr, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/external/internal_test.go",
+		"tools/please_go_test/test_data/external/xmain_test.go",
+	}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "TestMain", descr.Main.Name)
+	assert.Equal(t, "external_test.TestMain", descr.Qualify(descr.Main.Name, descr.Main.External))
+}
+
+func TestParseTestSourcesDuplicateTestMain(t *testing.T) {
+	_, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/external/main_test.go",
+		"tools/please_go_test/test_data/external/xmain_test.go",
+	}, TestMainOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "test_data/external/main_test.go")
+	assert.Contains(t, err.Error(), "test_data/external/xmain_test.go")
+}
+
+func TestParseTestSourcesReportsAllErrors(t *testing.T) {
+	_, err := parseTestSources([]string{
+		"tools/please_go_test/test_data/broken/one_test.go",
+		"tools/please_go_test/test_data/example_test.go",
+		"tools/please_go_test/test_data/broken/two_test.go",
+	}, TestMainOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed to parse 2 of 3 test sources")
+	assert.Contains(t, err.Error(), "test_data/broken/one_test.go:6")
+	assert.Contains(t, err.Error(), "test_data/broken/two_test.go:6")
+}
+
+func TestParseFilesKeepsOrder(t *testing.T) {
+	sources := []string{
+		"tools/please_go_test/test_data/platform/windows_test.go",
+		"tools/please_go_test/test_data/example_test.go",
+		"tools/please_go_test/test_data/platform/platform_test.go",
+		"tools/please_go_test/test_data/benchmark_test.go",
+	}
+	files, err := parseFiles(sources)
+	assert.NoError(t, err)
+	for i, f := range files {
+		assert.Equal(t, sources[i], f.Source)
+	}
+}
+
+func TestParseTestSourcesOrder(t *testing.T) {
+	sources := []string{
+		"tools/please_go_test/test_data/platform/windows_test.go",
+		"tools/please_go_test/test_data/platform/platform_test.go",
+	}
+	defer func(tags []string) { BuildTags = tags }(BuildTags)
+	BuildTags = []string{"windows"}
+	descr, err := parseTestSources(sources, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestAllPlatforms", "TestWindows"}, names(descr.Functions))
+	// Reversing the sources doesn't change anything.
+	descr, err = parseTestSources([]string{sources[1], sources[0]}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"TestAllPlatforms", "TestWindows"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesBenchmarks(t *testing.T) {
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/benchmark_test.go"}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BenchmarkSum"}, names(descr.Benchmarks))
+	assert.Equal(t, []string{"TestSum"}, names(descr.Functions))
+}
+
+func TestParseTestSourcesExamples(t *testing.T) {
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/example_output_test.go"}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []example{
+		{Name: "ExampleHello", Output: "hello\n"},
+		{Name: "ExampleUnordered", Output: "a\nb\n", Unordered: true},
+		{Name: "ExampleWrong", Output: "hello\n"},
+	}, descr.Examples)
+}
+
+func TestParseTestSourcesFuzzTargets(t *testing.T) {
+	descr, err := parseTestSources([]string{"tools/please_go_test/test_data/fuzz_test.go"}, TestMainOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FuzzReverse"}, names(descr.Fuzz))
+	assert.Equal(t, 0, len(descr.Functions))
 }
 
 func TestParseTestSourcesFailsGracefully(t *testing.T) {
-	_, err := parseTestSources([]string{"wibble"})
+	_, err := parseTestSources([]string{"wibble"}, TestMainOptions{})
 	assert.Error(t, err)
 }
 
+// version18 is the version of Go that most of these tests generate a main for.
+var version18 = GoVersion{Major: 1, Minor: 8}
+
 func TestWriteTestMain(t *testing.T) {
 	err := WriteTestMain(
 		"tools/please_go_test/test_data",
-		false, // not version 1.8
 		[]string{"tools/please_go_test/test_data/example_test.go"},
 		"test.go",
 		[]CoverVar{},
+		TestMainOptions{},
 	)
 	assert.NoError(t, err)
 	// It's not really practical to assert the contents of the file in great detail.
@@ -64,7 +336,6 @@ func TestWriteTestMain(t *testing.T) {
 func TestWriteTestMainWithCoverage(t *testing.T) {
 	err := WriteTestMain(
 		"tools/please_go_test/test_data",
-		false, // not version 1.8
 		[]string{"tools/please_go_test/test_data/example_test.go"},
 		"test.go",
 		[]CoverVar{{
@@ -73,6 +344,7 @@ func TestWriteTestMainWithCoverage(t *testing.T) {
 			Var:        "GoCover_lock_go",
 			File:       "tools/please_go_test/test_data/lock.go",
 		}},
+		TestMainOptions{},
 	)
 	assert.NoError(t, err)
 	// It's not really practical to assert the contents of the file in great detail.
@@ -82,25 +354,1303 @@ func TestWriteTestMainWithCoverage(t *testing.T) {
 	assert.Equal(t, "main", f.Name.Name)
 }
 
-func TestExtraImportPaths(t *testing.T) {
-	assert.Equal(t, extraImportPaths("core", "src/core", []CoverVar{
-		{ImportPath: "core"},
-		{ImportPath: "output"},
-	}), []string{
-		"core \"core\"",
-		"_cover0 \"core\"",
-		"_cover1 \"output\"",
-	})
+func TestWriteTestMainChecksCoverageFile(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{{
+			Dir:        "tools/please_go_test/test_data",
+			ImportPath: "core",
+			Var:        "GoCover_lock_go",
+			File:       "tools/please_go_test/test_data/lock.go",
+		}},
+		TestMainOptions{},
+	)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `if coverfile == "" {`)
+}
+
+func TestWriteTestMainTinyGo(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18, Target: "tinygo"},
+	)
+	assert.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", nil, parser.ImportsOnly)
+	assert.NoError(t, err)
+	for _, imp := range f.Imports {
+		assert.NotEqual(t, `"testing/internal/testdeps"`, imp.Path.Value)
+	}
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "testing.MainStart(testDeps, tests, benchmarks, fuzzTargets, examples)")
+}
+
+func TestWriteTestMainTinyGoRejectsCoverage(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{{
+			Dir:        "tools/please_go_test/test_data",
+			ImportPath: "core",
+			Var:        "GoCover_lock_go",
+			File:       "tools/please_go_test/test_data/lock.go",
+		}},
+		TestMainOptions{Target: "tinygo"},
+	)
+	assert.Error(t, err)
+}
+
+func TestWriteTestMainCreatesOutputDir(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"out/nested/test.go",
+		[]CoverVar{},
+		TestMainOptions{},
+	)
+	assert.NoError(t, err)
+	_, err = os.Stat("out/nested/test.go")
+	assert.NoError(t, err)
+}
+
+func TestWriteTestMainOutputDirError(t *testing.T) {
+	assert.NoError(t, ioutil.WriteFile("not_a_dir", nil, 0644))
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"not_a_dir/test.go",
+		[]CoverVar{},
+		TestMainOptions{},
+	)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not_a_dir/test.go")
+}
+
+func TestWriteTestMainExitsAfterTestMain(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/noexit_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18, ExitAfterTestMain: true},
+	)
+	assert.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "main", f.Name.Name)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "noexit.TestMain(m)")
+	assert.Contains(t, string(b), `reflect.ValueOf(m).Elem().FieldByName("exitCode")`)
+}
+
+func TestWriteTestMainAlwaysExitsAfterTestMainFromGo115(t *testing.T) {
+	sources := []string{"tools/please_go_test/test_data/noexit_test.go"}
+	err := WriteTestMain("tools/please_go_test/test_data", sources, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 15}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `reflect.ValueOf(m).Elem().FieldByName("exitCode")`)
+	// Older versions don't record the result so it's only done if asked for.
+	err = WriteTestMain("tools/please_go_test/test_data", sources, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 14}, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "reflect")
+}
+
+func TestWriteTestMainVerifyImports(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go isn't available to resolve imports")
+	}
+	err := WriteTestMain(
+		"tools/please_go_test/wibble", // This is deliberately wrong.
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoTool: "go", VerifyImports: true},
+	)
+	assert.Error(t, err)
+	// go list itself should have run and failed to find the package, which it reports after our message.
+	lines := strings.SplitN(err.Error(), "\n", 2)
+	assert.Equal(t, "Can't resolve import path tools/please_go_test/wibble/buildgo for the package under test: exit status 1", lines[0])
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[1], "tools/please_go_test/wibble/buildgo")
+	}
+}
+
+func TestWriteTestMainStructuredLogs(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/parallel_logging_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 12}, StructuredLogs: true},
+	)
+	assert.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "main", f.Name.Name)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "os.Exit(runWithStructuredLogs())")
+	assert.Contains(t, string(b), `{"TestLogsInParallel1", logging.TestLogsInParallel1}`)
+	assert.Contains(t, string(b), `{"TestLogsInParallel2", logging.TestLogsInParallel2}`)
+}
+
+func TestWriteTestMainStructuredLogsNeedGo112(t *testing.T) {
+	opts := TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 11}, StructuredLogs: true, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "runWithStructuredLogs")
+	// It can't be used in a library either, since there's no binary of ours to run again.
+	opts = TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 12}, StructuredLogs: true, LibraryPackage: "runner", Validate: true}
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "runWithStructuredLogs")
+}
+
+func TestWriteTestMainMultipleDirs(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{
+			"tools/please_go_test/test_data/example_test.go",
+			"tools/please_go_test/test_data/other/other_test.go",
+		},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18},
+	)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tools/please_go_test/test_data, tools/please_go_test/test_data/other")
+}
+
+func TestWriteTestMainCoverOnly(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{{
+			Dir:        "tools/please_go_test/test_data",
+			ImportPath: "core",
+			Var:        "GoCover_lock_go",
+			File:       "tools/please_go_test/test_data/lock.go",
+		}},
+		TestMainOptions{GoVersion: version18, CoverOnly: true},
+	)
+	assert.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", nil, parser.ImportsOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, "main", f.Name.Name)
+	imports := []string{}
+	for _, imp := range f.Imports {
+		imports = append(imports, imp.Path.Value)
+	}
+	assert.Contains(t, imports, `"core"`)
+	assert.NotContains(t, imports, `"tools/please_go_test/test_data/buildgo"`)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "testing.RegisterCover(")
+	assert.NotContains(t, string(b), "testing.MainStart(")
+}
+
+func TestWriteTestMainCoverageFiles(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{{
+			Dir:        "tools/please_go_test/test_data",
+			ImportPath: "core",
+			Var:        "GoCover_lock_go",
+			File:       "tools/please_go_test/test_data/lock.go",
+		}},
+		TestMainOptions{GoVersion: version18, Validate: true},
+	)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `os.Getenv("COVERAGE_FILES")`)
+	assert.Contains(t, string(b), `os.Getenv("TEST_SHARD_INDEX")`)
+	assert.Contains(t, string(b), "func selectCoverageFile(files string) (string, error) {")
+}
+
+func TestWriteTestMainCoverOnlyNeedsCoverage(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18, CoverOnly: true},
+	)
+	assert.Error(t, err)
+}
+
+func TestWriteTestList(t *testing.T) {
+	err := WriteTestList([]string{"tools/please_go_test/test_data/example_test.go"}, "tests.json", TestMainOptions{})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("tests.json")
+	assert.NoError(t, err)
+	functions := []TestFunction{}
+	assert.NoError(t, json.Unmarshal(b, &functions))
+	assert.Equal(t, 5, len(functions))
+	assert.Equal(t, TestFunction{
+		Name:   "TestReadPkgdef",
+		File:   "tools/please_go_test/test_data/example_test.go",
+		Filter: "^TestReadPkgdef$",
+	}, functions[0])
+	assert.Equal(t, "TestFindCoverVarsReturnsNothingForEmptyPath", functions[4].Name)
+}
+
+func TestWriteTestMainTestPlan(t *testing.T) {
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/example_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18},
+	)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `if os.Getenv("TEST_PLAN") != "" {`)
+	assert.Contains(t, string(b), "printTestPlan(testVar, benchVar)")
 }
 
-func TestIsVersion18(t *testing.T) {
-	assert.True(t, isVersion18([]byte("go version go1.8beta2 linux/amd64")))
-	assert.True(t, isVersion18([]byte("go version go1.8 linux/amd64")))
-	assert.True(t, isVersion18([]byte("go version go1.8.2 linux/amd64")))
-	assert.False(t, isVersion18([]byte("go version go1.7beta2 linux/amd64")))
-	assert.False(t, isVersion18([]byte("go version go1.7 linux/amd64")))
-	assert.False(t, isVersion18([]byte("go version go1.7.2 linux/amd64")))
-	assert.True(t, isVersion18([]byte("go version go1.10beta2 linux/amd64")))
-	assert.True(t, isVersion18([]byte("go version go1.10 linux/amd64")))
-	assert.True(t, isVersion18([]byte("go version go1.10.2 linux/amd64")))
+func TestWriteTestMainGoCoverDir(t *testing.T) {
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data",
+		ImportPath: "core",
+		Var:        "GoCover_lock_go",
+		File:       "tools/please_go_test/test_data/lock.go",
+	}}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 20}})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.gocoverdir", coverdir)`)
+	// Older versions shouldn't get it.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "-test.gocoverdir")
+}
+
+func TestWriteTestMainValidatesTestMainOnly(t *testing.T) {
+	// This used to generate a main that called mainonly.TestMain without importing mainonly.
+	err := WriteTestMain(
+		"tools/please_go_test/test_data",
+		[]string{"tools/please_go_test/test_data/main_only_test.go"},
+		"test.go",
+		[]CoverVar{},
+		TestMainOptions{GoVersion: version18, Validate: true},
+	)
+	assert.NoError(t, err)
+}
+
+func TestValidateTestMain(t *testing.T) {
+	src := "package main\n\nimport \"os\"\n\nfunc main() {\n\tmainonly.TestMain(nil)\n\tos.Exit(len(os.Args))\n}\n"
+	assert.NoError(t, ioutil.WriteFile("invalid.go", []byte(src), 0644))
+	err := validateTestMain("invalid.go")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined name mainonly")
+	assert.NoError(t, ioutil.WriteFile("invalid.go", []byte("package main\n\nfunc main() {"), 0644))
+	assert.Error(t, validateTestMain("invalid.go"))
+}
+
+func TestWriteTestMainRaceCoverage(t *testing.T) {
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data",
+		ImportPath: "core",
+		Var:        "GoCover_lock_go",
+		File:       "tools/please_go_test/test_data/lock.go",
+	}}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18, Race: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `Mode: "atomic",`)
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `Mode: "set",`)
+}
+
+func TestWriteTestMainGoMaxProcs(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, GoMaxProcs: 3})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "runtime.GOMAXPROCS(3)")
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "GOMAXPROCS")
+}
+
+func TestWriteTestMainSetupAndTeardown(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, SetupFunction: "TestMainSetup", TeardownFunction: "TestMainTeardown"}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/setup_teardown_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	main := string(b)
+	setup := strings.Index(main, "setup.TestMainSetup()")
+	run := strings.Index(main, "m.Run()")
+	teardown := strings.Index(main, "setup.TestMainTeardown()")
+	assert.True(t, setup != -1 && setup < run, "setup should be called before running tests")
+	assert.True(t, teardown != -1 && run < teardown, "teardown should be called after running tests")
+	// They shouldn't be registered as tests themselves.
+	assert.NotContains(t, main, `{"TestMainSetup"`)
+	assert.Contains(t, main, `{"TestIsSetUp", setup.TestIsSetUp}`)
+}
+
+func TestWriteTestMainSetupWithTestMain(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, SetupFunction: "TestMainSetup", TeardownFunction: "TestMainTeardown"}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{
+		"tools/please_go_test/test_data/setup_teardown_test.go",
+		"tools/please_go_test/test_data/main_only_test.go",
+	}, "test.go", []CoverVar{}, opts)
+	assert.Error(t, err)
+}
+
+func TestWriteTestMainSetupIsOptIn(t *testing.T) {
+	// Without the options, a helper that happens to be called TestMainSetup is left alone.
+	err := WriteTestMain("tools/please_go_test/test_data", []string{
+		"tools/please_go_test/test_data/setup_teardown_test.go",
+		"tools/please_go_test/test_data/main_only_test.go",
+	}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "setup.TestMainSetup()")
+}
+
+func TestWriteTestMainLeakCheck(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, LeakCheck: true, LeakGracePeriod: 2 * time.Second, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/leaky_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "goroutines := runtime.NumGoroutine()")
+	assert.Contains(t, string(b), "if !checkGoroutineLeaks(goroutines) && code == 0 {")
+	assert.Contains(t, string(b), "time.Duration(2000000000)")
+}
+
+func TestWriteTestMainLeakCheckWithTestMain(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, LeakCheck: true, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/main_only_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "checkGoroutineLeaks")
+}
+
+func TestWriteTestMainLeakCheckFailsRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := TestMainOptions{LeakCheck: true, LeakGracePeriod: 100 * time.Millisecond}
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/leaky_test.go"}, nil, opts)
+	out, code := runTestMain(t, binary)
+	assert.NotEqual(t, 0, code, out)
+	assert.Contains(t, out, "--- PASS: TestLeaksGoroutine")
+	assert.Contains(t, out, "1 goroutines leaked by tests:")
+	assert.Contains(t, out, "leaky.TestLeaksGoroutine")
+	// A run that doesn't leak anything passes as normal.
+	binary = buildTestMain(t, dir, []string{"tools/please_go_test/test_data/alloc_test.go"}, nil, opts)
+	out, code = runTestMain(t, binary)
+	assert.Equal(t, 0, code, out)
+	assert.NotContains(t, out, "leaked")
+}
+
+func TestWriteTestMainAsLibrary(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, LibraryPackage: "runner", Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "runner", f.Name.Name)
+	assert.NotNil(t, f.Scope.Lookup("RunTests"))
+	assert.Nil(t, f.Scope.Lookup("main"))
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "func RunTests() int {")
+	assert.Contains(t, string(b), "return(code)")
+	assert.NotContains(t, string(b), "os.Exit(")
+	// Nothing else that can fail should exit either.
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data/instrumented",
+		ImportPath: "tools/please_go_test/test_data/instrumented",
+		Var:        "GoCover_count_go",
+		File:       "tools/please_go_test/test_data/instrumented/count.go",
+	}}
+	opts = TestMainOptions{GoVersion: version18, LibraryPackage: "runner", StructuredLogs: true, Retries: true, CoverMode: "count", Validate: true}
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, opts)
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "func selectCoverageFile(")
+	assert.NotContains(t, string(b), "os.Exit(")
+}
+
+func TestParseTestImports(t *testing.T) {
+	imports, err := parseTestImports([]byte(`{
+	"ImportPath": "github.com/thought-machine/please/src/core",
+	"Imports": ["fmt", "os"],
+	"TestImports": ["testing", "github.com/stretchr/testify/assert", "os"],
+	"XTestImports": ["testing", "github.com/thought-machine/please/src/core"]
+}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"github.com/stretchr/testify/assert", "os", "testing"}, imports)
+}
+
+func TestParseTestImportsFailsGracefully(t *testing.T) {
+	_, err := parseTestImports([]byte("wibble"))
+	assert.Error(t, err)
+}
+
+func TestWriteAtomicallyKeepsOldOutputOnFailure(t *testing.T) {
+	assert.NoError(t, ioutil.WriteFile("atomic.go", []byte("package old"), 0644))
+	err := writeAtomically("atomic.go", func(f *os.File) error {
+		f.WriteString("package half_writt")
+		return fmt.Errorf("template failed")
+	})
+	assert.Error(t, err)
+	b, err := ioutil.ReadFile("atomic.go")
+	assert.NoError(t, err)
+	assert.Equal(t, "package old", string(b))
+	matches, _ := filepath.Glob(".atomic.go.tmp*")
+	assert.Empty(t, matches)
+}
+
+func TestWriteAtomicallyReplacesOutput(t *testing.T) {
+	assert.NoError(t, ioutil.WriteFile("atomic.go", []byte("package old"), 0644))
+	err := writeAtomically("atomic.go", func(f *os.File) error {
+		_, err := f.WriteString("package new")
+		return err
+	})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("atomic.go")
+	assert.NoError(t, err)
+	assert.Equal(t, "package new", string(b))
+}
+
+func TestWriteTestMains(t *testing.T) {
+	platforms := []Platform{{GOOS: "linux", GOARCH: "amd64"}, {GOOS: "windows", GOARCH: "amd64"}}
+	err := WriteTestMains("tools/please_go_test/test_data/platform", []string{
+		"tools/please_go_test/test_data/platform/platform_test.go",
+		"tools/please_go_test/test_data/platform/platform_linux_test.go",
+		"tools/please_go_test/test_data/platform/windows_test.go",
+	}, "test.go", platforms, []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test_linux_amd64.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "platform.TestAllPlatforms")
+	assert.Contains(t, string(b), "platform.TestLinux")
+	assert.NotContains(t, string(b), "platform.TestWindows")
+	b, err = ioutil.ReadFile("test_windows_amd64.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "platform.TestAllPlatforms")
+	assert.NotContains(t, string(b), "platform.TestLinux")
+	assert.Contains(t, string(b), "platform.TestWindows")
+}
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, Platform{GOOS: "linux", GOARCH: "arm64"}, p)
+	_, err = ParsePlatform("linux")
+	assert.Error(t, err)
+	_, err = ParsePlatform("wibble/amd64")
+	assert.Error(t, err)
+}
+
+func TestPlatformMatchesFileName(t *testing.T) {
+	p := Platform{GOOS: "linux", GOARCH: "amd64"}
+	assert.True(t, p.matchesFileName("foo_test.go"))
+	assert.True(t, p.matchesFileName("foo_linux_test.go"))
+	assert.True(t, p.matchesFileName("foo_linux_amd64_test.go"))
+	assert.True(t, p.matchesFileName("linux_test.go")) // The first element never counts.
+	assert.False(t, p.matchesFileName("foo_windows_test.go"))
+	assert.False(t, p.matchesFileName("foo_linux_arm64_test.go"))
+	assert.True(t, Platform{}.matchesFileName("foo_windows_test.go"))
+}
+
+func TestWriteTestMainMemStats(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, MemStats: true, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/alloc_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"TestAllocates", wrapTest("TestAllocates", alloc.TestAllocates)}`)
+	assert.Contains(t, string(b), "runtime.ReadMemStats(&before)")
+	assert.Contains(t, string(b), `os.Getenv("TEST_MEMSTATS_FILE")`)
+	assert.Contains(t, string(b), "writeMemStats()")
+}
+
+func TestWriteTestMainMemStatsWithTestMain(t *testing.T) {
+	opts := TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 15}, MemStats: true, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/main_only_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "writeMemStats")
+}
+
+func TestWriteTestMainWritesMemStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/alloc_test.go"}, nil, TestMainOptions{MemStats: true})
+	filename := filepath.Join(dir, "memstats.json")
+	out, code := runTestMain(t, binary, "TEST_MEMSTATS_FILE="+filename)
+	assert.Equal(t, 0, code, out)
+	b, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	var stats []struct {
+		Test       string
+		TotalAlloc uint64
+	}
+	assert.NoError(t, json.Unmarshal(b, &stats))
+	allocs := map[string]uint64{}
+	for _, s := range stats {
+		allocs[s.Test] = s.TotalAlloc
+	}
+	assert.Equal(t, 2, len(allocs), string(b))
+	assert.True(t, allocs["TestAllocates"] >= 100*1024*1024, string(b))
+	assert.True(t, allocs["TestDoesNotAllocate"] < 1024*1024, string(b))
+}
+
+func TestWriteTestMainAllocTests(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, AllocTests: true, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/allocs_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"AllocTestWithinBudget", checkAllocs(allocs.AllocTestWithinBudget, 0)}`)
+	assert.Contains(t, string(b), `{"AllocTestOverBudget", checkAllocs(allocs.AllocTestOverBudget, 0.5)}`)
+}
+
+func TestWriteTestMainAllocTestsCheckBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/allocs_test.go"}, nil, TestMainOptions{AllocTests: true})
+	out, code := runTestMain(t, binary, "TESTS=AllocTestWithinBudget")
+	assert.Equal(t, 0, code, out)
+	assert.Contains(t, out, "--- PASS: AllocTestWithinBudget")
+	out, code = runTestMain(t, binary, "TESTS=AllocTestOverBudget")
+	assert.NotEqual(t, 0, code, out)
+	assert.Contains(t, out, "--- FAIL: AllocTestOverBudget")
+	assert.Contains(t, out, "Made 1 allocations per run, over the budget of 0.5")
+}
+
+func TestWriteTestMainAllocTestsNeedBudget(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, AllocTests: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/allocs_nobudget_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.Error(t, err)
+}
+
+func TestWriteTestMainAllocTestsNeedFiniteBudget(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, AllocTests: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/allocs_infinite_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't a finite number")
+}
+
+func TestWriteTestMainBenchmarks(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/benchmark_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"BenchmarkSum", bench.BenchmarkSum}`)
+	assert.NotContains(t, string(b), "BenchmarkWrongSignature")
+	assert.Contains(t, string(b), `os.Getenv("BENCHMARKS")`)
+}
+
+func TestWriteTestMainExamples(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_output_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"ExampleHello", output.ExampleHello, "hello\n", false}`)
+	assert.Contains(t, string(b), `{"ExampleUnordered", output.ExampleUnordered, "a\nb\n", true}`)
+	assert.NotContains(t, string(b), "ExampleNoOutput")
+}
+
+func TestWriteTestMainFuzzTargets(t *testing.T) {
+	opts := TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 18}, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/fuzz_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"FuzzReverse", fuzz.FuzzReverse}`)
+	assert.Contains(t, string(b), "testing.MainStart(testDeps, tests, benchmarks, fuzzTargets, examples)")
+	assert.Contains(t, string(b), `os.Getenv("FUZZ")`)
+}
+
+func TestWriteTestMainFuzzesWithoutCorpusDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/fuzz_test.go"}, nil, TestMainOptions{})
+	cmd := exec.Command(binary, "-test.fuzztime", "100x")
+	cmd.Env = append(os.Environ(), "FUZZ=FuzzReverse", "FUZZ_CORPUS_DIR=", "TMP_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "--- PASS: FuzzReverse")
+	// The inputs it generated are kept under $TMP_DIR.
+	matches, err := filepath.Glob(filepath.Join(dir, "fuzz_cache*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(matches), "%v", matches)
+}
+
+func TestWriteTestMainFuzzTargetsNeedGo118(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/fuzz_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "FuzzReverse")
+	assert.Contains(t, string(b), "testing.MainStart(testDeps, tests, benchmarks, examples)")
+}
+
+func TestWriteTestMainCoverMode(t *testing.T) {
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data/instrumented",
+		ImportPath: "tools/please_go_test/test_data/instrumented",
+		Var:        "GoCover_count_go",
+		File:       "tools/please_go_test/test_data/instrumented/count.go",
+	}}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18, CoverMode: "count"})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `Mode: "count",`)
+	// It was instrumented in count mode so registering it as anything else should fail.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18})
+	assert.Error(t, err)
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18, CoverMode: "count", Race: true})
+	assert.Error(t, err)
+}
+
+func TestDetectCoverMode(t *testing.T) {
+	assert.Equal(t, "count", detectCoverMode("tools/please_go_test/test_data/instrumented/count.go", "GoCover_count_go"))
+	assert.Equal(t, "", detectCoverMode("tools/please_go_test/test_data/instrumented/count.go", "GoCover_other_go"))
+	assert.Equal(t, "", detectCoverMode("tools/please_go_test/test_data/lock.go", "GoCover_lock_go"))
+	assert.Equal(t, "", detectCoverMode("wibble", "GoCover_wibble_go"))
+}
+
+func TestCheckCoverSizes(t *testing.T) {
+	assert.NoError(t, checkCoverSizes("tools/please_go_test/test_data/instrumented/count.go", "GoCover_count_go"))
+	assert.NoError(t, checkCoverSizes("tools/please_go_test/test_data/lock.go", "GoCover_lock_go"))
+	assert.NoError(t, checkCoverSizes("wibble", "GoCover_wibble_go"))
+	err := checkCoverSizes("tools/please_go_test/test_data/instrumented/mismatched.go", "GoCover_mismatched_go")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mismatched.go")
+	assert.Contains(t, err.Error(), "2 counters, 3 positions and 1 statement counts")
+}
+
+func TestWriteTestMainChecksCoverSizes(t *testing.T) {
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data/instrumented",
+		ImportPath: "tools/please_go_test/test_data/instrumented",
+		Var:        "GoCover_mismatched_go",
+		File:       "tools/please_go_test/test_data/instrumented/mismatched.go",
+	}}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", coverVars, TestMainOptions{GoVersion: version18})
+	assert.Error(t, err)
+}
+
+func TestCoveredPackages(t *testing.T) {
+	assert.Equal(t, "", coveredPackages(nil))
+	assert.Equal(t, " in core, tools/please_go_test/test_data", coveredPackages([]CoverVar{
+		{ImportPath: "tools/please_go_test/test_data", Var: "GoCover_b_go"},
+		{ImportPath: "core", Var: "GoCover_lock_go"},
+		{ImportPath: "tools/please_go_test/test_data", Var: "GoCover_a_go"},
+	}))
+}
+
+func TestWriteTestMainCoveredPackages(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{{
+		Dir:        "tools/please_go_test/test_data",
+		ImportPath: "core",
+		Var:        "GoCover_lock_go",
+		File:       "tools/please_go_test/test_data/lock.go",
+	}}, TestMainOptions{GoVersion: version18})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `CoveredPackages: " in core",`)
+}
+
+func TestWriteTestMainTimeout(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `os.Getenv("TEST_TIMEOUT")`)
+	assert.Contains(t, string(b), `args = append(args, "-test.timeout", timeout)`)
+}
+
+func TestWriteTestMainShort(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `if envBool("TEST_SHORT") {`)
+	assert.Contains(t, string(b), `args = append(args, "-test.short")`)
+}
+
+func TestWriteTestMainParallelism(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.parallel", parallelism)`)
+	assert.Contains(t, string(b), `args = append(args, "-test.cpu", cpu)`)
+}
+
+func TestWriteTestMainJSONOutput(t *testing.T) {
+	opts := TestMainOptions{JSONOutput: true, GoVersion: GoVersion{Major: 1, Minor: 12}, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `if os.Getenv("TEST_OUTPUT") == "json" {`)
+	assert.Contains(t, string(b), `"Package": "tools/please_go_test/test_data/buildgo",`)
+	// It's not there unless asked for.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "runAsJSON")
+	assert.NotContains(t, string(b), `"os/exec"`)
+}
+
+func TestWriteTestMainJSONOutputNeedsGo112(t *testing.T) {
+	opts := TestMainOptions{JSONOutput: true, GoVersion: GoVersion{Major: 1, Minor: 11}, Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "ExitCode()")
+}
+
+func TestWriteTestMainJSONOutputNotForLibraries(t *testing.T) {
+	opts := TestMainOptions{GoVersion: version18, JSONOutput: true, LibraryPackage: "runner", Validate: true}
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, opts)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "runAsJSON")
+}
+
+func TestWriteTestMainFailFast(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 10}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.failfast")`)
+	// Older versions don't support it.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), `"-test.failfast"`)
+	assert.Contains(t, string(b), "$TEST_FAILFAST needs Go 1.10 or later")
+}
+
+func TestWriteTestMainSkip(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 20}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.skip", skipVar)`)
+	// Older versions don't support it.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 18}, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), `"-test.skip"`)
+	assert.Contains(t, string(b), "$TEST_SKIP needs Go 1.20 or later")
+}
+
+func TestWriteTestMainShuffle(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 17}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.shuffle", shuffle)`)
+	// Older versions don't support it.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 10}, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), `"-test.shuffle"`)
+	assert.Contains(t, string(b), "$TEST_SHUFFLE needs Go 1.17 or later")
+}
+
+func TestWriteTestMainPre18MatchesRegexps(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "testdeps.TestDeps")
+	assert.Contains(t, string(b), "matchRe, err = regexp.Compile(matchPat)")
+}
+
+func TestWriteTestMainProfiles(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 20}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"CPU_PROFILE", "-test.cpuprofile"},`)
+	assert.Contains(t, string(b), `{"MUTEX_PROFILE", "-test.mutexprofile"},`)
+	// Mutex profiles are newer than the others.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 7}, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"CPU_PROFILE", "-test.cpuprofile"},`)
+	assert.NotContains(t, string(b), `"-test.mutexprofile"`)
+	assert.Contains(t, string(b), "$MUTEX_PROFILE needs Go 1.8 or later")
+}
+
+func TestWriteTestMainList(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: GoVersion{Major: 1, Minor: 9}, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `args = append(args, "-test.list", listVar)`)
+	// Older versions don't support it.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), `"-test.list"`)
+	assert.Contains(t, string(b), "$TEST_LIST needs Go 1.9 or later")
+}
+
+func TestWriteTestMainSharding(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "shard, err := shardTests(tests)")
+	assert.Contains(t, string(b), `count := os.Getenv("TEST_SHARD_COUNT")`)
+}
+
+func TestWriteTestMainRetries(t *testing.T) {
+	err := WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Retries: true, Validate: true})
+	assert.NoError(t, err)
+	b, err := ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `{"TestReadPkgdef", wrapTest("TestReadPkgdef", buildgo.TestReadPkgdef)},`)
+	assert.Contains(t, string(b), `os.Getenv("TEST_RETRIES")`)
+	assert.Contains(t, string(b), `testing.RunTests(testDeps.MatchString, []testing.InternalTest{{name, attempt}})`)
+	// Retries only need to recognise the test markers, not follow which test is current.
+	assert.Contains(t, string(b), "func testMarker(line string) []string")
+	assert.NotContains(t, string(b), "testTracker")
+	// TinyGo can't run tests like this.
+	err = WriteTestMain("tools/please_go_test/test_data", []string{"tools/please_go_test/test_data/example_test.go"}, "test.go", []CoverVar{}, TestMainOptions{GoVersion: version18, Retries: true, Target: "tinygo", Validate: true})
+	assert.NoError(t, err)
+	b, err = ioutil.ReadFile("test.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "TEST_RETRIES")
+}
+
+func TestWriteTestMainRetriesOnlyReportLastAttempt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/flaky_test.go"}, nil, TestMainOptions{Retries: true})
+	out, code := runTestMain(t, binary, "TEST_RETRIES=2", "TESTS=TestFlaky")
+	assert.Equal(t, 0, code, out)
+	assert.NotContains(t, out, "--- FAIL")
+	assert.NotContains(t, out, "Failed on run")
+	assert.Equal(t, 1, strings.Count(out, "=== RUN   TestFlaky\n"), out)
+	assert.Contains(t, out, "--- PASS: TestFlaky")
+	assert.Contains(t, out, "TestFlaky passed on attempt 3 of 3")
+	// If every attempt fails, the test is reported as failing once, with the last attempt's output.
+	out, code = runTestMain(t, binary, "TEST_RETRIES=2", "TESTS=TestAlwaysFails")
+	assert.NotEqual(t, 0, code, out)
+	assert.Equal(t, 1, strings.Count(out, "--- FAIL"), out)
+	assert.Equal(t, 1, strings.Count(out, "Failed again"), out)
+	assert.Contains(t, out, "TestAlwaysFails failed all 3 attempts")
+}
+
+func TestWriteTestMainRetriesKeepOutputOnPanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/flaky_test.go"}, nil, TestMainOptions{Retries: true})
+	out, code := runTestMain(t, binary, "TEST_RETRIES=2", "TESTS=TestPanics")
+	assert.NotEqual(t, 0, code, out)
+	assert.Contains(t, out, "About to panic")
+	assert.Contains(t, out, "panic: oh no")
+}
+
+func TestWriteTestMainRetriesMultiplyCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/flaky_test.go"}, nil, TestMainOptions{Retries: true})
+	// Each attempt runs the test -test.count times over, so the last one reports both of its failures.
+	cmd := exec.Command(binary, "-test.count", "2")
+	cmd.Env = append(os.Environ(), "TEST_RETRIES=1", "TESTS=TestAlwaysFails")
+	b, err := cmd.CombinedOutput()
+	assert.Error(t, err)
+	out := string(b)
+	assert.Equal(t, 4, strings.Count(out, "Failed again"), out)
+	assert.Equal(t, 2, strings.Count(out, "TestAlwaysFails failed all 2 attempts"), out)
+}
+
+func TestExtraImportPaths(t *testing.T) {
+	descr := &testDescr{Package: "core", Functions: []function{{Name: "TestCore"}}}
+	assert.Equal(t, extraImportPaths(descr, "src/core", []CoverVar{
+		{ImportPath: "core"},
+		{ImportPath: "output"},
+	}), []string{
+		"core \"core\"",
+		coverImportName("core") + " \"core\"",
+		coverImportName("output") + " \"output\"",
+	})
+}
+
+func TestExtraImportPathsWindows(t *testing.T) {
+	assert.Equal(t, []string{
+		"core \"core\"",
+		coverImportName("output") + " \"output\"",
+	}, extraImportPaths(&testDescr{Package: "core", Functions: []function{{Name: "TestCore"}}}, `src\core`, []CoverVar{{ImportPath: "output"}}))
+	assert.Equal(t, "tools/please_go_test/test_data/buildgo", packageImportPath("buildgo", `tools\please_go_test\test_data`))
+}
+
+func TestExtraImportPathsSharesAliases(t *testing.T) {
+	coverVars := []CoverVar{
+		{ImportPath: "core", Var: "GoCover_lock_go"},
+		{ImportPath: "core", Var: "GoCover_utils_go"},
+	}
+	assert.Equal(t, []string{
+		"core \"core\"",
+		coverImportName("core") + " \"core\"",
+	}, extraImportPaths(&testDescr{Package: "core", Functions: []function{{Name: "TestCore"}}}, "src/core", coverVars))
+	assert.Equal(t, coverVars[0].ImportName, coverVars[1].ImportName)
+}
+
+func TestExtraImportPathsExternal(t *testing.T) {
+	descr := &testDescr{Package: "core", XPackage: "core_test", Functions: []function{{Name: "TestCore", External: true}}}
+	assert.Equal(t, []string{
+		"_ \"core\"",
+		"core_test \"core_test\"",
+	}, extraImportPaths(descr, "src/core", nil))
+}
+
+func TestWriteTestMainIsStable(t *testing.T) {
+	coverVars := []CoverVar{
+		{Dir: "src/core", ImportPath: "core", Var: "GoCover_lock_go", File: "src/core/lock.go"},
+		{Dir: "src/output", ImportPath: "output", Var: "GoCover_output_go", File: "src/output/output.go"},
+	}
+	sources := []string{"tools/please_go_test/test_data/example_test.go"}
+	assert.NoError(t, WriteTestMain("tools/please_go_test/test_data", sources, "test1.go", coverVars, TestMainOptions{GoVersion: version18}))
+	assert.NoError(t, WriteTestMain("tools/please_go_test/test_data", sources, "test2.go", coverVars, TestMainOptions{GoVersion: version18}))
+	b1, err := ioutil.ReadFile("test1.go")
+	assert.NoError(t, err)
+	b2, err := ioutil.ReadFile("test2.go")
+	assert.NoError(t, err)
+	assert.Equal(t, string(b1), string(b2))
+	assert.Contains(t, string(b1), coverImportName("core")+".GoCover_lock_go.Count[:]")
+}
+
+func TestParseGoVersion(t *testing.T) {
+	assert.Equal(t, GoVersion{Major: 1, Minor: 8}, parseGoVersion([]byte("go version go1.8beta2 linux/amd64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 8}, parseGoVersion([]byte("go version go1.8 linux/amd64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 8}, parseGoVersion([]byte("go version go1.8.2 linux/amd64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 21}, parseGoVersion([]byte("go version go1.21.3 linux/amd64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 22}, parseGoVersion([]byte("go version go1.22beta1 linux/amd64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 22}, parseGoVersion([]byte("go version go1.22rc2 darwin/arm64")))
+	assert.Equal(t, GoVersion{Major: 1, Minor: 23}, parseGoVersion([]byte("go version devel go1.23-a1b2c3d Tue Jan 2 15:04:05 2024 +0000 linux/amd64")))
+	assert.Equal(t, develVersion, parseGoVersion([]byte("go version devel +a1b2c3d Tue Jan 2 15:04:05 2018 +0000 linux/amd64")))
+	assert.Equal(t, GoVersion{}, parseGoVersion([]byte("wibble")))
+}
+
+func TestDetectGoVersionIsCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_version")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	goTool := writeFakeGoTool(t, dir, "go1.21.3")
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, GoVersion{Major: 1, Minor: 21}, DetectGoVersion(goTool))
+		}()
+	}
+	wg.Wait()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "run\n", string(b))
+}
+
+// writeFakeGoTool writes a script that reports the given version to the given directory and returns its path.
+// It writes a line to a file named runs each time it's run so we can count how often that is.
+func writeFakeGoTool(t *testing.T, dir, version string) string {
+	goTool := filepath.Join(dir, "go")
+	script := "#!/bin/sh\necho run >> " + filepath.Join(dir, "runs") + "\necho go version " + version + " linux/amd64\n"
+	assert.NoError(t, ioutil.WriteFile(goTool, []byte(script), 0755))
+	return goTool
+}
+
+func TestGoVersionAtLeast(t *testing.T) {
+	assert.True(t, GoVersion{Major: 1, Minor: 8}.AtLeast(8))
+	assert.False(t, GoVersion{Major: 1, Minor: 7}.AtLeast(8))
+	assert.True(t, GoVersion{Major: 1, Minor: 10}.AtLeast(8))
+	assert.True(t, GoVersion{Major: 1, Minor: 21}.AtLeast(20))
+	assert.False(t, GoVersion{Major: 1, Minor: 19}.AtLeast(20))
+	assert.True(t, GoVersion{Major: 2, Minor: 0}.AtLeast(20))
+	assert.True(t, develVersion.AtLeast(20))
+	assert.False(t, GoVersion{}.AtLeast(8))
+}
+
+func TestGoCommandSetsToolchain(t *testing.T) {
+	cmd := goCommand("go", "version")
+	assert.Equal(t, []string{"go", "version"}, cmd.Args)
+	assert.Equal(t, "GOTOOLCHAIN=local", cmd.Env[len(cmd.Env)-1])
+}
+
+func TestGoCommandAppliesGoEnv(t *testing.T) {
+	env, err := ReadGoEnv("tools/please_go_test/test_data/go_env")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GOFLAGS=-mod=mod", "GOPROXY=https://proxy.example.com"}, env)
+	GoEnv = append(env, "GOTOOLCHAIN=go1.21.0")
+	defer func() { GoEnv = nil }()
+	cmd := goCommand("go", "version")
+	assert.Equal(t, "-mod=mod", getEnv(cmd.Env, "GOFLAGS"))
+	assert.Equal(t, "go1.21.0", getEnv(cmd.Env, "GOTOOLCHAIN"))
+}
+
+func TestParseGoEnv(t *testing.T) {
+	_, err := ParseGoEnv([]string{"GOFLAGS=-mod=mod", "GOPROXY="})
+	assert.NoError(t, err)
+	_, err = ParseGoEnv([]string{"wibble"})
+	assert.Error(t, err)
+	_, err = ParseGoEnv([]string{"=wibble"})
+	assert.Error(t, err)
+}
+
+// getEnv returns the value of the given variable in an environment. Like exec, the last value wins.
+func getEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func TestWriteTestMainCompilesInEveryMode(t *testing.T) {
+	coverVars := []CoverVar{{
+		Dir:        "tools/please_go_test/test_data/instrumented",
+		ImportPath: "tools/please_go_test/test_data/instrumented",
+		Var:        "GoCover_count_go",
+		File:       "tools/please_go_test/test_data/instrumented/count.go",
+	}}
+	srcs := []string{"tools/please_go_test/test_data/setup_teardown_test.go"}
+	for name, opts := range map[string]TestMainOptions{
+		"default":         {},
+		"cover_only":      {CoverOnly: true, GoMaxProcs: 2},
+		"library":         {LibraryPackage: "tests"},
+		"cover_only_lib":  {CoverOnly: true, LibraryPackage: "tests"},
+		"structured_logs": {StructuredLogs: true},
+		"leak_check":      {LeakCheck: true},
+		"memstats":        {MemStats: true},
+		"retries":         {Retries: true},
+		"json_output":     {JSONOutput: true},
+		"everything":      {StructuredLogs: true, LeakCheck: true, MemStats: true, Retries: true, JSONOutput: true, GoMaxProcs: 2},
+	} {
+		opts.CoverMode = "count"
+		dir, err := ioutil.TempDir("", "test_main")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		buildTestMain(t, dir, srcs, coverVars, opts)
+		if t.Failed() {
+			t.Fatalf("Generated main doesn't build with %s", name)
+		}
+	}
+}
+
+// names returns the names of the given functions.
+func names(functions []function) []string {
+	ret := make([]string, len(functions))
+	for i, fn := range functions {
+		ret[i] = fn.Name
+	}
+	return ret
+}
+
+// stdImportCfg is an importcfg file for the standard library, built once by buildTestMain.
+var stdImportCfg struct {
+	once sync.Once
+	cfg  string
+	err  error
+}
+
+// currentGoVersion returns the version of the go tool on the PATH, skipping the test if there isn't one.
+func currentGoVersion(t *testing.T) GoVersion {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go isn't available to build test mains")
+	}
+	return DetectGoVersion("go")
+}
+
+// buildTestMain generates a test main for the given sources and builds it with the go tool, in the
+// same way that go_test does; the package under test and its external tests are compiled separately,
+// along with any packages that the cover vars refer to. It returns the path to the binary.
+// The test is skipped if go isn't available.
+func buildTestMain(t *testing.T, dir string, srcs []string, coverVars []CoverVar, opts TestMainOptions) string {
+	if opts.GoVersion == (GoVersion{}) {
+		opts.GoVersion = currentGoVersion(t)
+	}
+	stdImportCfg.once.Do(func() {
+		out, err := goCommand("go", "list", "-export", "-f", "{{if .Export}}packagefile {{.ImportPath}}={{.Export}}{{end}}", "std").Output()
+		stdImportCfg.cfg, stdImportCfg.err = string(out), err
+	})
+	if !assert.NoError(t, stdImportCfg.err) {
+		return ""
+	}
+	importcfg := filepath.Join(dir, "importcfg")
+	cfg := stdImportCfg.cfg
+	compile := func(importPath string, files []string) {
+		out := filepath.Join(dir, strings.Replace(importPath, "/", "_", -1)+".a")
+		args := append([]string{"tool", "compile", "-p", importPath, "-importcfg", importcfg, "-pack", "-o", out}, files...)
+		assert.NoError(t, ioutil.WriteFile(importcfg, []byte(cfg), 0644))
+		if b, err := goCommand("go", args...).CombinedOutput(); !assert.NoError(t, err, "%s", b) {
+			return
+		}
+		cfg += fmt.Sprintf("\npackagefile %s=%s", importPath, out)
+	}
+	for _, v := range coverVars {
+		if !strings.Contains(cfg, "packagefile "+v.ImportPath+"=") {
+			compile(v.ImportPath, []string{v.File})
+		}
+	}
+	descr, err := parseTestSources(srcs, opts)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	internal, external := []string{}, []string{}
+	for _, src := range srcs {
+		f, err := parser.ParseFile(token.NewFileSet(), src, nil, parser.PackageClauseOnly)
+		if !assert.NoError(t, err) {
+			return ""
+		} else if strings.HasSuffix(f.Name.Name, "_test") {
+			external = append(external, src)
+		} else {
+			internal = append(internal, src)
+		}
+	}
+	importPath := packageImportPath(descr.Package, "fixture")
+	if len(internal) > 0 {
+		compile(importPath, internal)
+	}
+	if len(external) > 0 {
+		compile(importPath+"_test", external)
+	}
+	main := filepath.Join(dir, "main.go")
+	if !assert.NoError(t, WriteTestMain("fixture", srcs, main, coverVars, opts)) {
+		return ""
+	}
+	if opts.LibraryPackage != "" {
+		// It's not a main, so the best we can do is check it compiles.
+		compile(opts.LibraryPackage, []string{main})
+		return ""
+	}
+	compile("main", []string{main})
+	binary := filepath.Join(dir, "test")
+	if b, err := goCommand("go", "tool", "link", "-importcfg", importcfg, "-o", binary, filepath.Join(dir, "main.a")).CombinedOutput(); !assert.NoError(t, err, "%s", b) {
+		return ""
+	}
+	return binary
+}
+
+// runTestMain runs a binary from buildTestMain with the given extra environment variables,
+// and returns its combined output and exit code.
+func runTestMain(t *testing.T, binary string, env ...string) (string, int) {
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	}
+	assert.NoError(t, err)
+	return string(out), 0
+}
+
+func TestWriteTestMainRunsAsJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/tagged_test.go"}, nil, TestMainOptions{JSONOutput: true})
+	out, code := runTestMain(t, binary, "TEST_OUTPUT=json")
+	assert.Equal(t, 0, code, out)
+	actions := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		event := struct{ Action, Test string }{}
+		if assert.NoError(t, json.Unmarshal([]byte(line), &event), line) && event.Action != "output" {
+			actions = append(actions, event.Action+" "+event.Test)
+		}
+	}
+	assert.Equal(t, []string{"run TestNotIntegration", "pass TestNotIntegration", "pass "}, actions)
+}
+
+func TestWriteTestMainStructuredLogsLeaveStdoutAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/parallel_logging_test.go"}, nil, TestMainOptions{StructuredLogs: true})
+	logs := filepath.Join(dir, "logs")
+	out, code := runTestMain(t, binary, "TEST_STRUCTURED_LOGS="+logs)
+	assert.Equal(t, 0, code, out)
+	// The output is still in the usual format, so it can be parsed as test results.
+	assert.True(t, strings.HasPrefix(out, "=== RUN   TestLogsInParallel1\n"), out)
+	assert.True(t, strings.HasSuffix(out, "\nPASS\n"), out)
+	b, err := ioutil.ReadFile(logs)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Contains(t, lines[0], " [TestLogsInParallel1] === RUN   TestLogsInParallel1")
+	assert.Contains(t, string(b), "[TestLogsInParallel2]     parallel_logging_test.go:")
+	assert.True(t, strings.HasSuffix(lines[len(lines)-1], " [] PASS"), lines[len(lines)-1])
+}
+
+func TestWriteTestMainStructuredLogsWithExitingTestMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_main")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildTestMain(t, dir, []string{"tools/please_go_test/test_data/exit_main_test.go"}, nil, TestMainOptions{StructuredLogs: true})
+	logs := filepath.Join(dir, "logs")
+	out, code := runTestMain(t, binary, "TEST_STRUCTURED_LOGS="+logs)
+	assert.Equal(t, 0, code, out)
+	// None of the output is lost when TestMain exits straight after the tests.
+	assert.Contains(t, out, "\nline 2000\n--- PASS: TestLotsOfOutput")
+	assert.True(t, strings.HasSuffix(out, "\nPASS\n"), out[len(out)-100:])
+	b, err := ioutil.ReadFile(logs)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "[TestLotsOfOutput] line 2000\n")
+	assert.Contains(t, string(b), "[] PASS\n")
 }